@@ -0,0 +1,66 @@
+package ratelimit
+
+import "fmt"
+
+// Algorithm selects how a Store enforces a Limit.
+type Algorithm uint8
+
+const (
+	// TokenBucket refills one token every Limit.Rate up to Limit.Capacity.
+	// After a quiet period a full Capacity burst is allowed at once.
+	TokenBucket Algorithm = iota
+	// SlidingWindow is a sliding window counter: it allows Limit.Capacity
+	// requests per window of Capacity * Rate. The count of the previous
+	// fixed window is weighted by how much of it still overlaps the
+	// sliding window, so a burst at the end of one window cannot be
+	// followed by a full burst at the start of the next.
+	SlidingWindow
+	// SlidingLog records the time of every request and allows
+	// Limit.Capacity requests in any window of Capacity * Rate, exactly.
+	// It keeps Capacity timestamps per key, so it is meant for low-volume
+	// limits such as password resets; Capacity is limited to 10000.
+	SlidingLog
+	// GCRA is the generic cell rate algorithm. It enforces the same limit
+	// as TokenBucket, one request every Limit.Rate with bursts of up to
+	// Limit.Capacity, but keeps a single timestamp per key (the theoretical
+	// arrival time of the next request) that is updated with a single
+	// compare-and-swap. Its MemoryStore entries are smaller than those of
+	// the other algorithms.
+	GCRA
+)
+
+// String returns the name of the algorithm.
+func (a Algorithm) String() string {
+	switch a {
+	case TokenBucket:
+		return "token-bucket"
+	case SlidingWindow:
+		return "sliding-window"
+	case SlidingLog:
+		return "sliding-log"
+	case GCRA:
+		return "gcra"
+	default:
+		return "unknown"
+	}
+}
+
+// valid reports whether a is a known algorithm.
+func (a Algorithm) valid() bool {
+	return a <= GCRA
+}
+
+// validate reports an error if limit cannot be enforced by the in-memory
+// algorithms.
+func (l Limit) validate() error {
+	if !l.Algorithm.valid() {
+		return fmt.Errorf("unknown algorithm %s", l.Algorithm)
+	}
+	if l.Rate <= 0 {
+		return fmt.Errorf("rate %s must be positive", l.Rate)
+	}
+	if l.Algorithm == SlidingLog {
+		return validateSlidingLog(l)
+	}
+	return nil
+}
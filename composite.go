@@ -0,0 +1,219 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// Bandwidth is one of several limits enforced on the same key, e.g. a
+// per-second limit next to a per-day limit. See NewCompositeRateLimiter and
+// RateLimiterConfig.Limits.
+type Bandwidth struct {
+	// Name identifies the limit in results, decisions and the RateLimit
+	// headers, e.g. "second" or "day". Names must be unique and consist of
+	// letters, digits, '-', '_' and '.'.
+	Name string
+	Limit
+}
+
+// defaultStaleAfter is how long a visitor can be idle before it is
+// evicted, unless its limits take longer to refill.
+const defaultStaleAfter = 10 * time.Minute
+
+// NewCompositeRateLimiter creates a rate limiter that enforces several
+// limits on every key, backed by an unbounded MemoryStore. A request only
+// consumes tokens if every limit allows it; the Result reports the limit
+// that rejected it or, for allowed requests, the one with the fewest
+// remaining tokens.
+//
+//	rl, err := NewCompositeRateLimiter(ctx,
+//		Bandwidth{Name: "second", Limit: Limit{Rate: time.Second / 10, Capacity: 10}},
+//		Bandwidth{Name: "day", Limit: Limit{Rate: 24 * time.Hour / 10000, Capacity: 10000}},
+//	)
+//
+// Stores implementing MultiTaker, such as MemoryStore and RedisStore, keep
+// all limits of a key in one entry and check them atomically. With other
+// stores each limit is kept under its own entry, and tokens taken from the
+// limits that allowed a rejected request are put back with Store.Refill,
+// so concurrent requests of the same key may briefly see them as taken;
+// requests are never allowed beyond any of the limits either way.
+func NewCompositeRateLimiter(ctx context.Context, bandwidths ...Bandwidth) (*RateLimiter, error) {
+	return newRateLimiter(ctx, bandwidths)
+}
+
+// validateBandwidths checks the names and limits of bandwidths.
+func validateBandwidths(bandwidths []Bandwidth) error {
+	if len(bandwidths) == 0 {
+		return fmt.Errorf("at least one limit is required")
+	}
+	seen := make(map[string]bool, len(bandwidths))
+	for _, bw := range bandwidths {
+		if !validBandwidthName(bw.Name) {
+			return fmt.Errorf("invalid limit name %q", bw.Name)
+		}
+		if seen[bw.Name] {
+			return fmt.Errorf("duplicate limit name %q", bw.Name)
+		}
+		seen[bw.Name] = true
+		if bw.Capacity <= 0 {
+			return fmt.Errorf("limit %q: capacity %d must be positive", bw.Name, bw.Capacity)
+		}
+		if err := bw.validate(); err != nil {
+			return fmt.Errorf("limit %q: %w", bw.Name, err)
+		}
+		if bw.Rate > maxRefillTime/time.Duration(bw.Capacity) {
+			return fmt.Errorf("limit %q: refilling %d tokens at %s takes longer than %s", bw.Name, bw.Capacity, bw.Rate, maxRefillTime)
+		}
+	}
+	return nil
+}
+
+// maxRefillTime bounds the time a limit takes to refill completely. The
+// algorithms add it to the current time in Unix nanoseconds, which must
+// not overflow.
+const maxRefillTime = 100 * 365 * 24 * time.Hour
+
+// validBandwidthName reports whether name can be sent as a policy name in
+// the RateLimit headers without quoting issues.
+func validBandwidthName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// staleAfter returns the default idle time after which visitors of
+// bandwidths are evicted. Evicting a bucket before it would have refilled
+// completely hands the client a fresh one, so a per-day limit must not be
+// forgotten after ten minutes.
+func staleAfter(bandwidths []Bandwidth) time.Duration {
+	stale := defaultStaleAfter
+	for _, bw := range bandwidths {
+		refill := time.Duration(bw.Capacity) * bw.Rate
+		if bw.Rate > 0 && refill/bw.Rate != time.Duration(bw.Capacity) {
+			// Overflow: the bucket never refills within a Duration.
+			return math.MaxInt64
+		}
+		if bw.Algorithm == SlidingWindow {
+			// The previous window counts until the current one ends.
+			refill *= 2
+		}
+		stale = max(stale, refill)
+	}
+	return stale
+}
+
+// setBandwidths sets the limits enforced by rl.
+func (rl *RateLimiter) setBandwidths(bandwidths []Bandwidth) {
+	rl.bandwidths = append([]Bandwidth(nil), bandwidths...)
+	rl.limits = make([]Limit, len(bandwidths))
+	for i, bw := range bandwidths {
+		rl.limits[i] = bw.Limit
+	}
+}
+
+// takeAll takes n tokens for key from every limit and appends the results
+// to results. A single limit and MultiTaker stores take them atomically;
+// with other stores the limits are taken one by one and rolled back if one
+// of them rejects the request.
+func (rl *RateLimiter) takeAll(ctx context.Context, key string, n int, now time.Time, results []TakeResult) ([]TakeResult, error) {
+	if len(rl.bandwidths) == 1 {
+		tr, err := rl.store.Take(ctx, rl.prefix+key, rl.bandwidths[0].Limit, n, now)
+		if err != nil {
+			return nil, err
+		}
+		return append(results, tr), nil
+	}
+	if mt, ok := rl.store.(MultiTaker); ok {
+		trs, err := mt.TakeAll(ctx, rl.prefix+key, rl.limits, n, now)
+		if err == nil && len(trs) != len(rl.limits) {
+			err = fmt.Errorf("store returned %d results for %d limits", len(trs), len(rl.limits))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return append(results, trs...), nil
+	}
+
+	allowed := true
+	for i, bw := range rl.bandwidths {
+		tr, err := rl.store.Take(ctx, rl.storeKey(key, i), bw.Limit, n, now)
+		if err != nil {
+			rl.rollback(ctx, key, results, n)
+			return nil, err
+		}
+		results = append(results, tr)
+		allowed = allowed && tr.Allowed
+	}
+	if !allowed {
+		rl.rollback(ctx, key, results, n)
+	}
+	return results, nil
+}
+
+// storeKey returns the key the state of bandwidth i is stored under in
+// stores that do not implement MultiTaker.
+func (rl *RateLimiter) storeKey(key string, i int) string {
+	return rl.prefix + key + "\x00" + rl.bandwidths[i].Name
+}
+
+// rollback returns the tokens taken from the limits that allowed a request
+// which is rejected after all, for stores that do not implement
+// MultiTaker. The tokens are returned even if ctx is already cancelled, so
+// an aborted request does not keep them.
+func (rl *RateLimiter) rollback(ctx context.Context, key string, results []TakeResult, n int) {
+	ctx = context.WithoutCancel(ctx)
+	for i, tr := range results {
+		if !tr.Allowed {
+			continue
+		}
+		if err := rl.store.Refill(ctx, rl.storeKey(key, i), rl.bandwidths[i].Limit, n); err != nil {
+			rl.logEvent(ctx, slog.LevelError, "failed to return tokens to rate limiter store", ReasonStoreError, key,
+				slog.String("policy", rl.bandwidths[i].Name), slog.Any("error", err))
+		}
+	}
+}
+
+// mostRestrictive returns the index of the result a caller is told about:
+// the rejecting limit that frees up last or, if every limit allowed the
+// take, the one with the fewest remaining tokens.
+func mostRestrictive(results []TakeResult) int {
+	best := 0
+	for i := 1; i < len(results); i++ {
+		tr, b := results[i], results[best]
+		switch {
+		case tr.Allowed != b.Allowed:
+			if !tr.Allowed {
+				best = i
+			}
+		case !tr.Allowed:
+			if retryAfter(tr) > retryAfter(b) {
+				best = i
+			}
+		case tr.Remaining < b.Remaining:
+			best = i
+		}
+	}
+	return best
+}
+
+// retryAfter returns the wait of a rejected take. A zero RetryAfter means
+// the take can never succeed.
+func retryAfter(tr TakeResult) time.Duration {
+	if tr.RetryAfter <= 0 {
+		return math.MaxInt64
+	}
+	return tr.RetryAfter
+}
@@ -0,0 +1,196 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestCompositeRateLimiter_AllLimitsMustAllow(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewCompositeRateLimiter(context.Background(),
+		Bandwidth{Name: "burst", Limit: Limit{Rate: time.Hour, Capacity: 2}},
+		Bandwidth{Name: "hour", Limit: Limit{Rate: time.Hour, Capacity: 3}},
+	)
+	assert.NoError(err)
+
+	res := rl.Take("k")
+	assert.True(res.Allowed)
+	assert.Equal("burst", res.Policy)
+	assert.Equal(2, res.Limit)
+	assert.Equal(1, res.Remaining)
+
+	assert.True(rl.Allow("k"))
+
+	// burst rejects; no token is taken from hour
+	res = rl.Take("k")
+	assert.False(res.Allowed)
+	assert.Equal("burst", res.Policy)
+	assert.Equal(1, bucketTokens(rl.store.(*MemoryStore), "k", 1))
+}
+
+// bucketTokens returns the tokens of limit i in the composite entry of key.
+func bucketTokens(s *MemoryStore, key string, i int) int {
+	c := s.load(key).(*compositeEntry)
+	return c.buckets[i].(*tokenBucketEntry).tokens(time.Now())
+}
+
+func TestCompositeRateLimiter_ConcurrentTakesAreAtomic(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewCompositeRateLimiter(context.Background(),
+		Bandwidth{Name: "small", Limit: Limit{Rate: time.Hour, Capacity: 10}},
+		Bandwidth{Name: "large", Limit: Limit{Rate: time.Hour, Capacity: 1000}},
+	)
+	assert.NoError(err)
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rl.Allow("k") {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(int64(10), allowed.Load())
+	// rejected requests never took tokens from the large limit
+	assert.Equal(990, bucketTokens(rl.store.(*MemoryStore), "k", 1))
+}
+
+func TestCompositeRateLimiter_FallbackRollsBack(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewCompositeRateLimiter(context.Background(),
+		Bandwidth{Name: "burst", Limit: Limit{Rate: time.Hour, Capacity: 1}},
+		Bandwidth{Name: "hour", Limit: Limit{Rate: time.Hour, Capacity: 3}},
+	)
+	assert.NoError(err)
+	store := NewMemoryStore(MemoryStoreConfig{})
+	// a store that does not implement MultiTaker
+	rl.store = struct{ Store }{store}
+
+	assert.True(rl.Allow("k"))
+	assert.False(rl.Allow("k"))
+	assert.Equal(2, store.load("k\x00hour").(*tokenBucketEntry).tokens(time.Now()))
+}
+
+func TestCompositeRateLimiter_ReportsLongestWait(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewCompositeRateLimiter(context.Background(),
+		Bandwidth{Name: "second", Limit: Limit{Rate: time.Second, Capacity: 1}},
+		Bandwidth{Name: "day", Limit: Limit{Rate: 24 * time.Hour, Capacity: 1}},
+	)
+	assert.NoError(err)
+
+	assert.True(rl.Allow("k"))
+	res, reason, err := rl.take(context.Background(), "k", 1)
+	assert.NoError(err)
+	assert.Equal(ReasonRate, reason)
+	assert.Equal("day", res.Policy)
+	assert.Greater(res.RetryAfter, 23*time.Hour)
+}
+
+func TestCompositeRateLimiter_CountsKeysAgainstMaxKeys(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewCompositeRateLimiter(context.Background(),
+		Bandwidth{Name: "a", Limit: Limit{Rate: time.Hour, Capacity: 2}},
+		Bandwidth{Name: "b", Limit: Limit{Rate: time.Hour, Capacity: 2}},
+	)
+	assert.NoError(err)
+	store := NewMemoryStore(MemoryStoreConfig{MaxKeys: 1})
+	rl.store = store
+
+	// both limits of a key share one entry
+	assert.True(rl.Allow("k"))
+	n, err := store.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	res, reason, err := rl.take(context.Background(), "other", 1)
+	assert.NoError(err)
+	assert.Equal(ReasonMaxClients, reason)
+	assert.False(res.Allowed)
+}
+
+func TestCompositeRateLimiter_Validation(t *testing.T) {
+	assert := a.New(t)
+
+	limit := Limit{Rate: time.Second, Capacity: 1}
+	for name, bandwidths := range map[string][]Bandwidth{
+		"none":            nil,
+		"empty name":      {{Limit: limit}},
+		"invalid name":    {{Name: `a"b`, Limit: limit}},
+		"duplicate name":  {{Name: "a", Limit: limit}, {Name: "a", Limit: limit}},
+		"zero capacity":   {{Name: "a", Limit: Limit{Rate: time.Second}}},
+		"zero rate":       {{Name: "a", Limit: Limit{Capacity: 1}}},
+		"refill overflow": {{Name: "a", Limit: Limit{Rate: 24 * time.Hour, Capacity: 200000}}},
+	} {
+		_, err := NewCompositeRateLimiter(context.Background(), bandwidths...)
+		assert.Error(err, name)
+	}
+}
+
+func TestCompositeRateLimiter_KeepsSlowLimitsUntilRefilled(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewCompositeRateLimiter(context.Background(),
+		Bandwidth{Name: "second", Limit: Limit{Rate: time.Second / 10, Capacity: 10}},
+		Bandwidth{Name: "day", Limit: Limit{Rate: 24 * time.Hour / 10000, Capacity: 10000}},
+	)
+	assert.NoError(err)
+	assert.Equal(24*time.Hour, time.Duration(rl.visitorStaleAfter.Load()))
+
+	assert.Equal(defaultStaleAfter, staleAfter([]Bandwidth{{Limit: Limit{Rate: time.Second, Capacity: 10}}}))
+	assert.Equal(2*time.Hour, staleAfter([]Bandwidth{{Limit: Limit{Rate: time.Minute, Capacity: 60, Algorithm: SlidingWindow}}}))
+}
+
+func TestRateLimitMiddleware_Limits(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		Context: context.Background(),
+		Limits: []Bandwidth{
+			{Name: "second", Limit: Limit{Rate: time.Second / 10, Capacity: 10}},
+			{Name: "minute", Limit: Limit{Rate: time.Minute / 2, Capacity: 2}},
+		},
+	})
+	assert.NoError(err)
+
+	var rw *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rw = httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+	}
+
+	assert.Equal(http.StatusTooManyRequests, rw.Code)
+	assert.Equal(`"second";q=10;w=1, "minute";q=2;w=60`, rw.Header().Get("RateLimit-Policy"))
+	assert.Equal(`"minute";r=0;t=60`, rw.Header().Get("RateLimit"))
+	assert.Equal("30", rw.Header().Get("Retry-After"))
+}
+
+func TestRateLimitMiddleware_LimitsExcludeSingleLimit(t *testing.T) {
+	assert := a.New(t)
+
+	_, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 10,
+		Context:           context.Background(),
+		Limits:            []Bandwidth{{Name: "second", Limit: Limit{Rate: time.Second, Capacity: 1}}},
+	})
+	assert.Error(err)
+}
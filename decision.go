@@ -0,0 +1,45 @@
+package ratelimit
+
+import "net/http"
+
+// Reasons for rejected requests, as reported in Decision.Reason, log events
+// and metrics.
+const (
+	// ReasonRate means the bucket of the key was empty.
+	ReasonRate = "rate"
+	// ReasonMaxClients means the store was full and could not track a new key.
+	ReasonMaxClients = "max-clients"
+	// ReasonNoKey means the key of the request could not be determined,
+	// e.g. because the client IP is missing or invalid.
+	ReasonNoKey = "no-key"
+	// ReasonStoreError means the store failed.
+	ReasonStoreError = "store-error"
+	// ReasonCost means the request costs more tokens than a limit can hold
+	// (or a negative amount), so it would never be allowed.
+	ReasonCost = "cost"
+	// ReasonClosed means the rate limiter was closed, see Middleware.Close.
+	ReasonClosed = "closed"
+)
+
+// Decision describes how RateLimitMiddleware handled a request. It is
+// passed to RateLimiterConfig.OnDecision.
+type Decision struct {
+	Result
+	// Key is the key the request was limited by. It is empty for
+	// ReasonNoKey.
+	Key string
+	// Reason is empty for allowed requests and one of the Reason constants
+	// otherwise.
+	Reason string
+	// Cost is the number of tokens the request was charged, see
+	// RateLimiterConfig.CostFunc.
+	Cost int
+	// Route names the RoutePolicy that applied to the request, or
+	// "default" if none matched.
+	Route string
+}
+
+// DecisionFunc observes rate limiting decisions, e.g. to annotate traces.
+// It is called synchronously before the request is passed on or rejected,
+// so it must be fast and must not write to the response.
+type DecisionFunc func(r *http.Request, d Decision)
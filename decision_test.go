@@ -0,0 +1,41 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitMiddleware_OnDecision(t *testing.T) {
+	assert := a.New(t)
+
+	var decisions []Decision
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		KeyFunc:           HeaderKey("X-Client"),
+		OnDecision: func(r *http.Request, d Decision) {
+			decisions = append(decisions, d)
+		},
+	})
+	assert.NoError(err)
+
+	for _, client := range []string{"a", "a", ""} {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("X-Client", client)
+		middleware(httptest.NewRecorder(), req, func(w http.ResponseWriter, r *http.Request) {})
+	}
+
+	if assert.Len(decisions, 3) {
+		assert.Equal(Decision{Result: Result{Allowed: true, Limit: 1, Remaining: 0, ResetAfter: decisions[0].ResetAfter, Policy: "default"}, Key: "a", Cost: 1, Route: "default"}, decisions[0])
+		assert.False(decisions[1].Allowed)
+		assert.Equal("a", decisions[1].Key)
+		assert.Equal(ReasonRate, decisions[1].Reason)
+		assert.Greater(decisions[1].RetryAfter, time.Duration(0))
+		assert.Equal(Decision{Result: Result{Limit: 1, Policy: "default"}, Reason: ReasonNoKey, Route: "default"}, decisions[2])
+	}
+}
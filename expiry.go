@@ -0,0 +1,111 @@
+package ratelimit
+
+// The entries of a shard are kept in a min-heap ordered by
+// entryMeta.expires, the time after which the entry was last known to be
+// idle. Takes move the time an entry goes idle forward without touching
+// the heap; when the heap says an entry is due, its current activeUntil is
+// checked and the entry is either evicted or moved back into the heap at
+// its new time. Each entry is therefore only looked at when it may be
+// stale, and at most once more per stale period while it is in use.
+
+// push adds e to the expiry heap of sh. The caller must hold sh.mu for
+// writing.
+func (sh *memoryShard) push(e entry) {
+	e.meta().index = len(sh.expiry)
+	sh.expiry = append(sh.expiry, e)
+	sh.up(len(sh.expiry) - 1)
+}
+
+// pop removes the entry at index i of the expiry heap of sh. The caller
+// must hold sh.mu for writing.
+func (sh *memoryShard) pop(i int) {
+	last := len(sh.expiry) - 1
+	if i != last {
+		sh.swap(i, last)
+	}
+	sh.expiry[last] = nil
+	sh.expiry = sh.expiry[:last]
+	if i != last {
+		sh.fix(i)
+	}
+}
+
+// fix restores the heap order after the expiry time of the entry at index
+// i changed. The caller must hold sh.mu for writing.
+func (sh *memoryShard) fix(i int) {
+	if !sh.down(i) {
+		sh.up(i)
+	}
+}
+
+func (sh *memoryShard) less(i, j int) bool {
+	return sh.expiry[i].meta().expires < sh.expiry[j].meta().expires
+}
+
+func (sh *memoryShard) swap(i, j int) {
+	sh.expiry[i], sh.expiry[j] = sh.expiry[j], sh.expiry[i]
+	sh.expiry[i].meta().index = i
+	sh.expiry[j].meta().index = j
+}
+
+func (sh *memoryShard) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !sh.less(i, parent) {
+			return
+		}
+		sh.swap(i, parent)
+		i = parent
+	}
+}
+
+// down moves the entry at index i towards the leaves and reports whether
+// it moved.
+func (sh *memoryShard) down(i int) bool {
+	start := i
+	n := len(sh.expiry)
+	for {
+		child := 2*i + 1
+		if child >= n {
+			break
+		}
+		if right := child + 1; right < n && sh.less(right, child) {
+			child = right
+		}
+		if !sh.less(child, i) {
+			break
+		}
+		sh.swap(i, child)
+		i = child
+	}
+	return i > start
+}
+
+// evictStale removes the entries of sh that are idle since before cutoff,
+// in Unix nanoseconds. Only entries the heap says are due are inspected.
+// The lock is released after every chunk entries so that requests are not
+// held up by a large number of entries expiring at once. It returns the
+// number of entries inspected and evicted.
+func (sh *memoryShard) evictStale(cutoff int64, chunk int) (int, int) {
+	scanned, evicted := 0, 0
+	for {
+		sh.mu.Lock()
+		for n := 0; n < chunk && len(sh.expiry) > 0 && sh.expiry[0].meta().expires < cutoff; n++ {
+			e := sh.expiry[0]
+			scanned++
+			if until := e.activeUntil().UnixNano(); until >= cutoff {
+				// Used since it was scheduled.
+				e.meta().expires = until
+				sh.fix(0)
+				continue
+			}
+			sh.remove(e)
+			evicted++
+		}
+		done := len(sh.expiry) == 0 || sh.expiry[0].meta().expires >= cutoff
+		sh.mu.Unlock()
+		if done {
+			return scanned, evicted
+		}
+	}
+}
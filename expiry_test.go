@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"context"
+	"math/rand/v2"
+	"strconv"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore_EvictOnlyInspectsDueEntries(t *testing.T) {
+	assert := a.New(t)
+
+	s := NewMemoryStore(MemoryStoreConfig{CleanupBatchSize: 3})
+	limit := Limit{Rate: time.Second, Capacity: 1}
+	now := time.Now()
+	for i := 0; i < 1000; i++ {
+		_, err := s.Take(context.Background(), strconv.Itoa(i), limit, 1, now.Add(time.Duration(i)*time.Second))
+		assert.NoError(err)
+	}
+
+	// nothing is due yet
+	scanned, evicted, err := s.evictScan(context.Background(), now)
+	assert.NoError(err)
+	assert.Equal(0, scanned)
+	assert.Equal(0, evicted)
+
+	// Key i is full again at now+(i+1)s. Entries are scheduled when they
+	// are created, before their first take, so key 10 is due at now+10s
+	// and moved back to now+11s.
+	scanned, evicted, err = s.evictScan(context.Background(), now.Add(10*time.Second+time.Millisecond))
+	assert.NoError(err)
+	assert.Equal(11, scanned)
+	assert.Equal(10, evicted)
+
+	// a key used since it was scheduled is looked at once more and moved
+	// back again
+	_, err = s.Take(context.Background(), "10", limit, 1, now.Add(time.Hour))
+	assert.NoError(err)
+	scanned, evicted, err = s.evictScan(context.Background(), now.Add(11*time.Second+time.Millisecond))
+	assert.NoError(err)
+	assert.Equal(2, scanned, "keys 10 and 11")
+	assert.Equal(0, evicted)
+	assert.NotNil(s.load("10"))
+
+	scanned, evicted, err = s.evictScan(context.Background(), now.Add(12*time.Second+time.Millisecond))
+	assert.NoError(err)
+	assert.Equal(2, scanned, "keys 11 and 12")
+	assert.Equal(1, evicted)
+}
+
+func TestMemoryStore_ExpiryHeapOrder(t *testing.T) {
+	assert := a.New(t)
+
+	s := NewMemoryStore(MemoryStoreConfig{Shards: 1, MaxKeys: 50, OverflowPolicy: OverflowEvictRandomTwo})
+	limit := Limit{Rate: time.Second, Capacity: 1}
+	now := time.Now()
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 1000; i++ {
+		at := now.Add(time.Duration(rnd.IntN(3600)) * time.Second)
+		_, err := s.Take(context.Background(), strconv.Itoa(rnd.IntN(120)), limit, 1, at)
+		assert.NoError(err)
+		if i%50 == 0 {
+			_, _, err = s.evictScan(context.Background(), at.Add(-30*time.Minute))
+			assert.NoError(err)
+		}
+	}
+
+	sh := s.shards[0]
+	for i, e := range sh.expiry {
+		assert.Equal(i, e.meta().index)
+		if i > 0 {
+			assert.LessOrEqual(sh.expiry[(i-1)/2].meta().expires, e.meta().expires)
+		}
+	}
+	assert.Len(sh.visitors, len(sh.expiry))
+}
@@ -0,0 +1,266 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// forwardedHeader is the canonical name of the RFC 7239 header.
+const forwardedHeader = "Forwarded"
+
+// forwardedElement holds the parameters of one element of an RFC 7239
+// Forwarded header. Values are unquoted; absent parameters are empty.
+// Extension parameters are validated but not kept.
+type forwardedElement struct {
+	For   string
+	By    string
+	Host  string
+	Proto string
+}
+
+// parseForwarded parses the values of one or more Forwarded header lines
+// into their elements, left-most first. Repeated header lines form a single
+// list. Empty list elements are skipped as required for list-based fields.
+//
+// The parser follows the RFC 7239 grammar: parameter names are tokens and
+// case-insensitive, values are tokens or quoted strings with backslash
+// escapes, and a parameter must not occur twice within one element.
+// Optional whitespace around ',' and ';' is tolerated.
+func parseForwarded(values []string) ([]forwardedElement, error) {
+	var out []forwardedElement
+	for _, v := range values {
+		var err error
+		out, err = parseForwardedValue(v, out)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func parseForwardedValue(s string, out []forwardedElement) ([]forwardedElement, error) {
+	i := 0
+	for {
+		var elem forwardedElement
+		var seen []string
+		pairs := 0
+
+		// parse the pairs of one element up to ',' or the end of s
+		for {
+			i = skipOWS(s, i)
+			if i == len(s) || s[i] == ',' {
+				break
+			}
+			if s[i] == ';' {
+				i++
+				continue
+			}
+
+			start := i
+			for i < len(s) && isTokenChar(s[i]) {
+				i++
+			}
+			if i == start {
+				return nil, fmt.Errorf("invalid character %q at offset %d", s[i], i)
+			}
+			name := strings.ToLower(s[start:i])
+			if i == len(s) || s[i] != '=' {
+				return nil, fmt.Errorf("missing '=' after parameter %q", name)
+			}
+			i++
+
+			var value string
+			var err error
+			value, i, err = parseForwardedParamValue(s, i)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for parameter %q: %w", name, err)
+			}
+
+			for _, n := range seen {
+				if n == name {
+					return nil, fmt.Errorf("duplicate parameter %q", name)
+				}
+			}
+			seen = append(seen, name)
+			pairs++
+
+			switch name {
+			case "for":
+				elem.For = value
+			case "by":
+				elem.By = value
+			case "host":
+				elem.Host = value
+			case "proto":
+				elem.Proto = value
+			}
+
+			i = skipOWS(s, i)
+			if i < len(s) && s[i] != ';' && s[i] != ',' {
+				return nil, fmt.Errorf("invalid character %q at offset %d", s[i], i)
+			}
+		}
+
+		if pairs > 0 {
+			out = append(out, elem)
+		}
+		if i == len(s) {
+			return out, nil
+		}
+		i++ // skip ','
+	}
+}
+
+// parseForwardedParamValue parses a token or quoted-string starting at i and
+// returns the unquoted value and the offset after it.
+func parseForwardedParamValue(s string, i int) (string, int, error) {
+	if i < len(s) && s[i] == '"' {
+		return parseQuotedString(s, i)
+	}
+	start := i
+	for i < len(s) && isTokenChar(s[i]) {
+		i++
+	}
+	if i == start {
+		return "", i, fmt.Errorf("empty value")
+	}
+	return s[start:i], i, nil
+}
+
+// parseQuotedString parses an RFC 7230 quoted-string starting at the
+// opening quote at s[i].
+func parseQuotedString(s string, i int) (string, int, error) {
+	var b strings.Builder
+	for i++; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), i + 1, nil
+		case c == '\\':
+			i++
+			if i == len(s) {
+				return "", i, fmt.Errorf("unterminated escape")
+			}
+			if !isQuotedTextChar(s[i]) && s[i] != '"' && s[i] != '\\' {
+				return "", i, fmt.Errorf("invalid escaped character %q", s[i])
+			}
+			b.WriteByte(s[i])
+		case isQuotedTextChar(c):
+			b.WriteByte(c)
+		default:
+			return "", i, fmt.Errorf("invalid character %q in quoted string", c)
+		}
+	}
+	return "", i, fmt.Errorf("unterminated quoted string")
+}
+
+// parseForwardedNode returns the normalized IP address of an RFC 7239 node
+// ("192.0.2.43:47011", "[2001:db8::1]", ...). It returns empty for the
+// "unknown" identifier, obfuscated identifiers such as "_hidden" and
+// anything that is not a well-formed node.
+func parseForwardedNode(node string) string {
+	host := node
+	port := ""
+	if strings.HasPrefix(node, "[") {
+		end := strings.IndexByte(node, ']')
+		if end < 0 {
+			return ""
+		}
+		host, port = node[1:end], node[end+1:]
+		if port != "" {
+			if port[0] != ':' {
+				return ""
+			}
+			port = port[1:]
+		}
+	} else if i := strings.IndexByte(node, ':'); i >= 0 {
+		host, port = node[:i], node[i+1:]
+	}
+	if port != "" || strings.HasSuffix(node, ":") {
+		if !isForwardedPort(port) {
+			return ""
+		}
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil || addr.Zone() != "" {
+		// "unknown", obfuscated identifiers and malformed nodes
+		return ""
+	}
+	// IPv6 addresses must be bracketed and IPv4 addresses must not be.
+	if addr.Is6() != strings.HasPrefix(node, "[") {
+		return ""
+	}
+	return addr.String()
+}
+
+// isForwardedPort reports whether p is a node-port: 1*5DIGIT or an
+// obfuscated port starting with '_'.
+func isForwardedPort(p string) bool {
+	if p == "" {
+		return false
+	}
+	if p[0] == '_' {
+		if len(p) == 1 {
+			return false
+		}
+		for i := 1; i < len(p); i++ {
+			c := p[i]
+			if !isAlphaNum(c) && c != '.' && c != '_' && c != '-' {
+				return false
+			}
+		}
+		return true
+	}
+	if len(p) > 5 {
+		return false
+	}
+	for i := 0; i < len(p); i++ {
+		if p[i] < '0' || p[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardedClientHops returns the for= nodes of a Forwarded header as a hop
+// list, left-most first. Nodes that do not carry an IP address ("unknown",
+// obfuscated identifiers, missing for=) are returned as empty strings so
+// callers can tell they cannot identify that hop.
+func forwardedClientHops(values []string) ([]string, error) {
+	elems, err := parseForwarded(values)
+	if err != nil {
+		return nil, err
+	}
+	hops := make([]string, 0, len(elems))
+	for _, e := range elems {
+		hops = append(hops, parseForwardedNode(e.For))
+	}
+	return hops, nil
+}
+
+func skipOWS(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+func isAlphaNum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// isTokenChar reports whether c is an RFC 7230 tchar.
+func isTokenChar(c byte) bool {
+	if isAlphaNum(c) {
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// isQuotedTextChar reports whether c may appear unescaped in a
+// quoted-string (qdtext).
+func isQuotedTextChar(c byte) bool {
+	return c == '\t' || c == ' ' || c == 0x21 || (c >= 0x23 && c <= 0x5B) || (c >= 0x5D && c <= 0x7E) || c >= 0x80
+}
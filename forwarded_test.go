@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestParseForwarded_Valid(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []forwardedElement
+	}{
+		{
+			name:   "single pair",
+			values: []string{"for=192.0.2.60"},
+			want:   []forwardedElement{{For: "192.0.2.60"}},
+		},
+		{
+			name:   "all parameters",
+			values: []string{`for=192.0.2.60;proto=http;by=203.0.113.43;host=example.com`},
+			want:   []forwardedElement{{For: "192.0.2.60", By: "203.0.113.43", Host: "example.com", Proto: "http"}},
+		},
+		{
+			name:   "quoted ipv6 with port",
+			values: []string{`For="[2001:db8:cafe::17]:4711"`},
+			want:   []forwardedElement{{For: "[2001:db8:cafe::17]:4711"}},
+		},
+		{
+			name:   "multiple elements",
+			values: []string{`for=192.0.2.43, for="[2001:db8:cafe::17]", for=unknown`},
+			want:   []forwardedElement{{For: "192.0.2.43"}, {For: "[2001:db8:cafe::17]"}, {For: "unknown"}},
+		},
+		{
+			name:   "repeated header lines",
+			values: []string{"for=192.0.2.43", "for=198.51.100.17;by=_hidden"},
+			want:   []forwardedElement{{For: "192.0.2.43"}, {For: "198.51.100.17", By: "_hidden"}},
+		},
+		{
+			name:   "quoted comma and escapes",
+			values: []string{`for=192.0.2.43;ext="a,b\"c\\d"`},
+			want:   []forwardedElement{{For: "192.0.2.43"}},
+		},
+		{
+			name:   "empty elements and pairs",
+			values: []string{` , for=192.0.2.43;;proto=https ,,`},
+			want:   []forwardedElement{{For: "192.0.2.43", Proto: "https"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseForwarded(tt.values)
+			a.NoError(t, err)
+			a.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseForwarded_Invalid(t *testing.T) {
+	for _, v := range []string{
+		"for",
+		"for=",
+		"for=192.0.2.43 junk",
+		`for="192.0.2.43`,
+		`for="192.0.2.43\`,
+		"for=192.0.2.43;for=192.0.2.44",
+		"FOR=192.0.2.43;for=192.0.2.44",
+		"for=[2001:db8::1]",
+		"=192.0.2.43",
+		"for=\"192.0.2.43\n\"",
+		"for=192.0.2.43,by=\x00",
+	} {
+		_, err := parseForwarded([]string{v})
+		a.Error(t, err, "value %q", v)
+	}
+}
+
+func TestParseForwardedNode(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.43":              "192.0.2.43",
+		"192.0.2.43:47011":        "192.0.2.43",
+		"192.0.2.43:_port":        "192.0.2.43",
+		"[2001:db8:cafe::17]":     "2001:db8:cafe::17",
+		"[2001:db8:cafe::17]:443": "2001:db8:cafe::17",
+		"unknown":                 "",
+		"unknown:80":              "",
+		"_hidden":                 "",
+		"_SEVKISEK":               "",
+		"2001:db8:cafe::17":       "",
+		"[192.0.2.43]":            "",
+		"192.0.2.43:":             "",
+		"192.0.2.43:123456":       "",
+		"192.0.2.43:_":            "",
+		"[2001:db8::1]80":         "",
+		"[fe80::1%eth0]":          "",
+		"[2001:db8::1":            "",
+		"":                        "",
+	}
+	for node, want := range tests {
+		a.Equal(t, want, parseForwardedNode(node), "node %q", node)
+	}
+}
+
+func TestGetClientIP_ForwardedHeader(t *testing.T) {
+	assert := a.New(t)
+	limiter, err := NewRateLimiter(context.Background(), 10)
+	assert.NoError(err)
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("Forwarded", `for=_hidden, for="[2001:db8::1]:4711";proto=https, for=192.0.2.43`)
+
+	// without trusted proxies the left-most node with an IP is used
+	assert.Equal("2001:db8::1", limiter.getClientIP(req, "forwarded"))
+
+	// a malformed header is not trusted at all
+	req.Header.Set("Forwarded", `for="[2001:db8::1]:4711`)
+	assert.Equal("", limiter.getClientIP(req, "Forwarded"))
+}
+
+func TestGetClientIP_ForwardedHeaderTrustedProxies(t *testing.T) {
+	limiter, err := NewRateLimiter(context.Background(), 10)
+	a.NoError(t, err)
+	limiter.trustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"single hop", `for="[2001:db8::1]:4711";proto=https;by=10.0.0.1`, "2001:db8::1"},
+		{"forged prefix is skipped", `for=1.2.3.4, for=192.0.2.43, for=10.0.0.2`, "192.0.2.43"},
+		{"obfuscated client", `for=_hidden, for=10.0.0.2`, ""},
+		{"unknown client", `for=unknown`, ""},
+		{"missing for", `proto=https`, ""},
+		{"malformed", `for=192.0.2.43;for=192.0.2.44`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("Forwarded", tt.header)
+			a.Equal(t, tt.want, limiter.getClientIP(req, "Forwarded"))
+		})
+	}
+}
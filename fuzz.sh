@@ -3,7 +3,9 @@
 set -euo pipefail
 
 go test -fuzz=FuzzGetClientIP -fuzztime=120s
+go test -fuzz=FuzzParseForwarded -fuzztime=120s
 go test -fuzz=FuzzAllow -fuzztime=240s
 
 go test -fuzz=FuzzGetClientIP -race -fuzztime=20s
+go test -fuzz=FuzzParseForwarded -race -fuzztime=20s
 go test -fuzz=FuzzAllow -race -fuzztime=20s
\ No newline at end of file
@@ -0,0 +1,112 @@
+package ratelimit
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// gcraEntry is the entry of a key limited with GCRA. Its state is the
+// theoretical arrival time (TAT) of the next request in Unix nanoseconds,
+// updated with compare-and-swap, so it needs neither a lock nor the fields
+// of the other algorithms.
+type gcraEntry struct {
+	entryMeta
+	// limit is the limit the entry was created for. A key used with a
+	// different limit gets a new entry.
+	limit Limit
+	tat   atomic.Int64
+}
+
+func newGCRAEntry(limit Limit, now time.Time) *gcraEntry {
+	e := &gcraEntry{limit: limit}
+	e.tat.Store(now.UnixNano())
+	return e
+}
+
+// holds implements entry.
+func (e *gcraEntry) holds(limit Limit) bool {
+	return limit == e.limit
+}
+
+// take implements entry.
+func (e *gcraEntry) take(limit Limit, n int, now time.Time) TakeResult {
+	return e.reserve(limit, n, now, 0)
+}
+
+// reserve implements entry. It retries until the TAT it computed from is
+// still current.
+func (e *gcraEntry) reserve(limit Limit, n int, now time.Time, maxWait time.Duration) TakeResult {
+	for {
+		tat := e.tat.Load()
+		res, next := gcraReserve(tat, limit, n, now, maxWait)
+		if !res.Allowed || e.tat.CompareAndSwap(tat, next) {
+			return res
+		}
+	}
+}
+
+// refund implements entry by moving the TAT back by n emission intervals.
+func (e *gcraEntry) refund(limit Limit, n int) {
+	if limit.Algorithm != GCRA {
+		return
+	}
+	e.tat.Add(-int64(n) * int64(limit.Rate))
+}
+
+// fill implements entry.
+func (e *gcraEntry) fill(now time.Time) float64 {
+	t := now.UnixNano()
+	interval := int64(e.limit.Rate)
+	start := max(e.tat.Load(), t)
+	remaining := gcraRemaining(int64(e.limit.Capacity)*interval, interval, start-t)
+	return float64(remaining) / float64(e.limit.Capacity)
+}
+
+// size implements entry.
+func (e *gcraEntry) size() int64 {
+	return int64(unsafe.Sizeof(*e))
+}
+
+// activeUntil implements entry. Once the TAT has passed, the key has its
+// full burst available again.
+func (e *gcraEntry) activeUntil() time.Time {
+	return time.Unix(0, e.tat.Load())
+}
+
+// gcraReserve admits n requests if the TAT of the next request, pushed
+// back by n emission intervals, stays within the burst tolerance of
+// Capacity * Rate, or gets there within maxWait. A TAT in the past means
+// the key is idle and its full burst is available. It returns the outcome
+// and, for admitted requests, the new TAT. RetryAfter of an allowed result
+// is the time until the requests conform.
+func gcraReserve(tat int64, limit Limit, n int, now time.Time, maxWait time.Duration) (TakeResult, int64) {
+	t := now.UnixNano()
+	interval := int64(limit.Rate)
+	tolerance := int64(limit.Capacity) * interval
+
+	start := max(tat, t)
+	res := TakeResult{
+		Remaining:  gcraRemaining(tolerance, interval, start-t),
+		ResetAfter: time.Duration(start - t),
+	}
+	if n > limit.Capacity {
+		return res, tat
+	}
+	next := start + int64(n)*interval
+	res.RetryAfter = time.Duration(max(next-tolerance-t, 0))
+	if res.RetryAfter > maxWait {
+		return res, tat
+	}
+	res.Allowed = true
+	res.Remaining = gcraRemaining(tolerance, interval, next-t)
+	res.ResetAfter = time.Duration(next - t)
+	return res, next
+}
+
+// gcraRemaining returns the number of requests that conform when the TAT
+// is ahead of now by ahead nanoseconds. Reservations can push the TAT
+// beyond the tolerance.
+func gcraRemaining(tolerance, interval, ahead int64) int {
+	return max(int((tolerance-ahead)/interval), 0)
+}
@@ -0,0 +1,135 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+
+	ratelimit "github.com/stfsy/go-rate-limit"
+)
+
+func TestGCRA_RateAndBurst(t *testing.T) {
+	assert := a.New(t)
+
+	// one request every 100ms with bursts of up to 3
+	limit := ratelimit.Limit{Rate: 100 * time.Millisecond, Capacity: 3, Algorithm: ratelimit.GCRA}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	epoch := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		res, err := s.Take(ctx, "k", limit, 1, epoch)
+		assert.NoError(err)
+		assert.Equal(ratelimit.TakeResult{Allowed: true, Remaining: 2 - i, ResetAfter: time.Duration(i+1) * 100 * time.Millisecond}, res)
+	}
+
+	res, err := s.Take(ctx, "k", limit, 1, epoch.Add(40*time.Millisecond))
+	assert.NoError(err)
+	assert.Equal(ratelimit.TakeResult{Remaining: 0, ResetAfter: 260 * time.Millisecond, RetryAfter: 60 * time.Millisecond}, res)
+
+	res, err = s.Take(ctx, "k", limit, 1, epoch.Add(100*time.Millisecond))
+	assert.NoError(err)
+	assert.True(res.Allowed)
+
+	// more than the burst never fits
+	res, err = s.Take(ctx, "k", limit, 4, epoch.Add(time.Hour))
+	assert.NoError(err)
+	assert.Equal(ratelimit.TakeResult{Remaining: 3}, res)
+
+	// after a long idle period the full burst is available again
+	res, err = s.Take(ctx, "k", limit, 3, epoch.Add(time.Hour))
+	assert.NoError(err)
+	assert.Equal(ratelimit.TakeResult{Allowed: true, Remaining: 0, ResetAfter: 300 * time.Millisecond}, res)
+}
+
+func TestGCRA_Refill(t *testing.T) {
+	assert := a.New(t)
+
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 3, Algorithm: ratelimit.GCRA}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	assert.Equal(3, takeAll(t, s, "k", limit, now))
+	assert.NoError(s.Refill(ctx, "k", limit, 2))
+	assert.Equal(2, takeAll(t, s, "k", limit, now))
+	// refunds never exceed the burst
+	assert.NoError(s.Refill(ctx, "k", limit, 10))
+	assert.Equal(3, takeAll(t, s, "k", limit, now))
+}
+
+func TestGCRA_Evict(t *testing.T) {
+	assert := a.New(t)
+
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 3, Algorithm: ratelimit.GCRA}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	assert.Equal(3, takeAll(t, s, "k", limit, now))
+
+	// the key is active until its theoretical arrival time
+	evicted, err := s.Evict(ctx, now.Add(2*time.Second))
+	assert.NoError(err)
+	assert.Equal(0, evicted)
+	evicted, err = s.Evict(ctx, now.Add(4*time.Second))
+	assert.NoError(err)
+	assert.Equal(1, evicted)
+}
+
+func TestGCRA_ConcurrentTake(t *testing.T) {
+	assert := a.New(t)
+
+	limit := ratelimit.Limit{Rate: time.Hour, Capacity: 50, Algorithm: ratelimit.GCRA}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	now := time.Now()
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := s.Take(context.Background(), "k", limit, 1, now)
+			assert.NoError(err)
+			if res.Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int64(50), allowed.Load())
+}
+
+func TestRateLimitMiddleware_GCRAWithBurst(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{
+		RequestsPerMinute: 60,
+		Burst:             2,
+		Context:           context.Background(),
+		Algorithm:         ratelimit.GCRA,
+	})
+	assert.NoError(err)
+
+	codes := make([]int, 0, 3)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rw := httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		codes = append(codes, rw.Code)
+		if i == 2 {
+			// a burst of 2 refilled at one request per second
+			assert.Equal(`"default";q=2;w=2`, rw.Header().Get("RateLimit-Policy"))
+			assert.Equal("1", rw.Header().Get("Retry-After"))
+		}
+	}
+	assert.Equal([]int{200, 200, 429}, codes)
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPolicyName names the quota policy in the RateLimit headers.
+const defaultPolicyName = "default"
+
+// setRateLimitHeaders writes the RateLimit and RateLimit-Policy headers of
+// draft-ietf-httpapi-ratelimit-headers for res, e.g.
+//
+//	RateLimit-Policy: "default";q=100;w=60
+//	RateLimit: "default";r=42;t=5
+//
+// q is the bucket capacity and w the time it takes to refill it from empty;
+// r is the number of remaining tokens and t the time until the bucket is
+// full again. RateLimit-Policy lists every limit in bandwidths while
+// RateLimit only describes res.Policy, the most restrictive one. With
+// legacy set, the X-RateLimit-Limit, X-RateLimit-Remaining and
+// X-RateLimit-Reset (Unix time in seconds) headers are added as well.
+func setRateLimitHeaders(h http.Header, res Result, bandwidths []Bandwidth, legacy bool, now time.Time) {
+	reset := ceilSeconds(res.ResetAfter)
+
+	var policy strings.Builder
+	for i, bw := range bandwidths {
+		if i > 0 {
+			policy.WriteString(", ")
+		}
+		window := time.Duration(bw.Capacity) * bw.Rate
+		policy.WriteString(`"` + bw.Name + `";q=` + strconv.Itoa(bw.Capacity) + ";w=" + strconv.FormatInt(ceilSeconds(window), 10))
+	}
+	h.Set("RateLimit-Policy", policy.String())
+	h.Set("RateLimit", `"`+res.Policy+`";r=`+strconv.Itoa(res.Remaining)+";t="+strconv.FormatInt(reset, 10))
+
+	if legacy {
+		h.Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("X-RateLimit-Reset", strconv.FormatInt(now.Unix()+reset, 10))
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds. Header consumers must never be
+// told to come back before a token is available.
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestSetRateLimitHeaders(t *testing.T) {
+	assert := a.New(t)
+
+	h := http.Header{}
+	now := time.Unix(1_700_000_000, 0)
+	res := Result{Allowed: true, Limit: 100, Remaining: 42, ResetAfter: 4200 * time.Millisecond, Policy: "default"}
+	bandwidths := []Bandwidth{{Name: "default", Limit: Limit{Rate: 600 * time.Millisecond, Capacity: 100}}}
+	setRateLimitHeaders(h, res, bandwidths, false, now)
+
+	assert.Equal(`"default";q=100;w=60`, h.Get("RateLimit-Policy"))
+	assert.Equal(`"default";r=42;t=5`, h.Get("RateLimit"))
+	assert.Empty(h.Get("X-RateLimit-Limit"))
+
+	setRateLimitHeaders(h, res, bandwidths, true, now)
+	assert.Equal("100", h.Get("X-RateLimit-Limit"))
+	assert.Equal("42", h.Get("X-RateLimit-Remaining"))
+	assert.Equal("1700000005", h.Get("X-RateLimit-Reset"))
+}
+
+func TestCeilSeconds(t *testing.T) {
+	assert := a.New(t)
+
+	assert.Equal(int64(0), ceilSeconds(-time.Second))
+	assert.Equal(int64(0), ceilSeconds(0))
+	assert.Equal(int64(1), ceilSeconds(time.Nanosecond))
+	assert.Equal(int64(1), ceilSeconds(time.Second))
+	assert.Equal(int64(2), ceilSeconds(time.Second+time.Nanosecond))
+}
+
+func TestRateLimitMiddleware_RateLimitHeaders(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{RequestsPerMinute: 2, Context: context.Background(), LegacyRateLimitHeaders: true})
+	assert.NoError(err)
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rw := httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		return rw
+	}
+
+	rw := serve()
+	assert.Equal(200, rw.Code)
+	assert.Equal(`"default";q=2;w=60`, rw.Header().Get("RateLimit-Policy"))
+	assert.Equal(`"default";r=1;t=30`, rw.Header().Get("RateLimit"))
+	assert.Equal("2", rw.Header().Get("X-RateLimit-Limit"))
+	assert.Equal("1", rw.Header().Get("X-RateLimit-Remaining"))
+
+	rw = serve()
+	assert.Equal(200, rw.Code)
+	assert.Equal(`"default";r=0;t=60`, rw.Header().Get("RateLimit"))
+
+	// rejected responses carry the headers as well
+	rw = serve()
+	assert.Equal(429, rw.Code)
+	assert.Equal(`"default";q=2;w=60`, rw.Header().Get("RateLimit-Policy"))
+	assert.Equal(`"default";r=0;t=60`, rw.Header().Get("RateLimit"))
+	assert.Equal("0", rw.Header().Get("X-RateLimit-Remaining"))
+}
+
+func TestRateLimitMiddleware_DisableRateLimitHeaders(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{RequestsPerMinute: 2, Context: context.Background(), DisableRateLimitHeaders: true})
+	assert.NoError(err)
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rw := httptest.NewRecorder()
+	middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+
+	assert.Equal(200, rw.Code)
+	assert.Empty(rw.Header().Get("RateLimit"))
+	assert.Empty(rw.Header().Get("RateLimit-Policy"))
+}
@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// KeyFunc extracts the key a request is rate limited by. Requests sharing a
+// key share a bucket. A KeyFunc returns an error, or an empty key, when it
+// cannot identify the caller; RateLimitMiddleware rejects such requests
+// with 400 Bad Request.
+type KeyFunc func(r *http.Request) (string, error)
+
+// ErrNoClientIP is returned by IPKey when the client IP cannot be determined.
+var ErrNoClientIP = errors.New("could not determine client IP")
+
+// IPKey keys requests by client IP. trustedHeader and trustedProxies have
+// the same meaning as RateLimiterConfig.TrustedProxyHeader and
+// RateLimiterConfig.TrustedProxies. This is the default KeyFunc of
+// RateLimitMiddleware; use it explicitly when composing keys.
+func IPKey(trustedHeader string, trustedProxies ...netip.Prefix) KeyFunc {
+	masked := make([]netip.Prefix, 0, len(trustedProxies))
+	for _, p := range trustedProxies {
+		masked = append(masked, p.Masked())
+	}
+	return func(r *http.Request) (string, error) {
+		ip := clientIP(r, trustedHeader, masked)
+		if ip == "" {
+			return "", ErrNoClientIP
+		}
+		return ip, nil
+	}
+}
+
+// HeaderKey keys requests by the value of the named header, e.g. an API
+// token or tenant ID. Validate the header upstream (for example with
+// TokenHeaderMiddleware) so clients cannot pick arbitrary keys. The value
+// is used as is, so it will be visible in the store.
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		v := strings.TrimSpace(r.Header.Get(name))
+		if v == "" {
+			return "", fmt.Errorf("header %q is missing", name)
+		}
+		return v, nil
+	}
+}
+
+// ContextKey keys requests by a value that upstream middleware, usually
+// authentication, stored in the request context under key. The value must
+// be a string or implement fmt.Stringer.
+func ContextKey(key any) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		switch v := r.Context().Value(key).(type) {
+		case string:
+			return v, nil
+		case fmt.Stringer:
+			return v.String(), nil
+		case nil:
+			return "", fmt.Errorf("context value %v is missing", key)
+		default:
+			return "", fmt.Errorf("context value %v has unsupported type %T", key, v)
+		}
+	}
+}
+
+// ErrNoRoute is returned by RouteKey and PatternKey when the request did
+// not match a route.
+var ErrNoRoute = errors.New("request did not match a route")
+
+// RouteKey keys requests by the ServeMux pattern that matched the request
+// (http.Request.Pattern). The pattern is only set inside a handler of an
+// http.ServeMux; elsewhere RouteKey fails with ErrNoRoute rather than
+// falling back to the URL path, which would let clients mint a bucket per
+// path. Use PatternKey when the middleware runs in front of the mux.
+func RouteKey(r *http.Request) (string, error) {
+	if r.Pattern == "" {
+		return "", ErrNoRoute
+	}
+	return r.Pattern, nil
+}
+
+// PatternKey keys requests by the pattern that matches them, in the syntax
+// and with the precedence rules of http.ServeMux, e.g. "GET /users/{id}".
+// Unlike RouteKey it does not depend on running inside a mux handler.
+// Requests that match none of the patterns fail with ErrNoRoute; add "/"
+// to key them together instead. An error is returned for invalid and
+// conflicting patterns.
+func PatternKey(patterns ...string) (KeyFunc, error) {
+	mux := http.NewServeMux()
+	known := make(map[string]bool, len(patterns))
+	for _, p := range patterns {
+		if err := handlePattern(mux, p); err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", p, err)
+		}
+		known[p] = true
+	}
+	return func(r *http.Request) (string, error) {
+		pattern := matchPattern(mux, r, func(pattern string) bool { return known[pattern] })
+		if !known[pattern] {
+			return "", ErrNoRoute
+		}
+		return pattern, nil
+	}, nil
+}
+
+// CompositeKey combines several key functions, e.g.
+// CompositeKey(IPKey(""), routes) with routes returned by PatternKey for a
+// limit per client and route. The parts are joined with '|'; '|' and '\'
+// inside parts are escaped so that different combinations never produce
+// the same key. If any part fails, the composite fails.
+func CompositeKey(fns ...KeyFunc) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		var b strings.Builder
+		for i, fn := range fns {
+			part, err := fn(r)
+			if err != nil {
+				return "", err
+			}
+			if strings.TrimSpace(part) == "" {
+				return "", fmt.Errorf("key part %d is empty", i)
+			}
+			if i > 0 {
+				b.WriteByte('|')
+			}
+			for j := 0; j < len(part); j++ {
+				if part[j] == '|' || part[j] == '\\' {
+					b.WriteByte('\\')
+				}
+				b.WriteByte(part[j])
+			}
+		}
+		return b.String(), nil
+	}
+}
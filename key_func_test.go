@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+type tenantID string
+
+func (t tenantID) String() string { return "tenant-" + string(t) }
+
+type ctxKey struct{}
+
+func TestIPKey(t *testing.T) {
+	assert := a.New(t)
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.2.3.4, 198.51.100.1")
+
+	key, err := IPKey("")(req)
+	assert.NoError(err)
+	assert.Equal("10.0.0.1", key)
+
+	key, err = IPKey("X-Forwarded-For", netip.MustParsePrefix("10.0.0.0/8"))(req)
+	assert.NoError(err)
+	assert.Equal("198.51.100.1", key)
+
+	req.RemoteAddr = ""
+	_, err = IPKey("")(req)
+	assert.ErrorIs(err, ErrNoClientIP)
+}
+
+func TestHeaderKey(t *testing.T) {
+	assert := a.New(t)
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("X-Api-Token", "tok_123")
+
+	key, err := HeaderKey("x-api-token")(req)
+	assert.NoError(err)
+	assert.Equal("tok_123", key)
+
+	req.Header.Set("X-Api-Token", "  ")
+	_, err = HeaderKey("X-Api-Token")(req)
+	assert.Error(err)
+
+	_, err = HeaderKey("X-Missing")(req)
+	assert.Error(err)
+}
+
+func TestContextKey(t *testing.T) {
+	assert := a.New(t)
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	_, err := ContextKey(ctxKey{})(req)
+	assert.Error(err)
+
+	key, err := ContextKey(ctxKey{})(req.WithContext(context.WithValue(req.Context(), ctxKey{}, "user-1")))
+	assert.NoError(err)
+	assert.Equal("user-1", key)
+
+	key, err = ContextKey(ctxKey{})(req.WithContext(context.WithValue(req.Context(), ctxKey{}, tenantID("a"))))
+	assert.NoError(err)
+	assert.Equal("tenant-a", key)
+
+	_, err = ContextKey(ctxKey{})(req.WithContext(context.WithValue(req.Context(), ctxKey{}, 42)))
+	assert.Error(err)
+}
+
+func TestRouteKey(t *testing.T) {
+	assert := a.New(t)
+
+	// outside of a mux handler there is no route to key by
+	req := httptest.NewRequest("GET", "/users/42", nil)
+	_, err := RouteKey(req)
+	assert.ErrorIs(err, ErrNoRoute)
+
+	var key string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		key, err = RouteKey(r)
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NoError(err)
+	assert.Equal("GET /users/{id}", key)
+}
+
+func TestPatternKey(t *testing.T) {
+	assert := a.New(t)
+
+	keyFunc, err := PatternKey("GET /users/{id}", "POST /users/{id}/avatar")
+	assert.NoError(err)
+
+	key, err := keyFunc(httptest.NewRequest("GET", "/users/42", nil))
+	assert.NoError(err)
+	assert.Equal("GET /users/{id}", key)
+	key, err = keyFunc(httptest.NewRequest("GET", "/users/43", nil))
+	assert.NoError(err)
+	assert.Equal("GET /users/{id}", key, "paths matching the same pattern share a key")
+
+	_, err = keyFunc(httptest.NewRequest("GET", "/unknown", nil))
+	assert.ErrorIs(err, ErrNoRoute)
+
+	// a missing trailing slash matches the subtree the mux redirects to
+	keyFunc, err = PatternKey("GET /export/")
+	assert.NoError(err)
+	key, err = keyFunc(httptest.NewRequest("GET", "/export", nil))
+	assert.NoError(err)
+	assert.Equal("GET /export/", key)
+
+	_, err = PatternKey("GET /a/{x}", "GET /a/{y}")
+	assert.ErrorContains(err, "conflicts")
+}
+
+func TestCompositeKey(t *testing.T) {
+	assert := a.New(t)
+
+	req := httptest.NewRequest("GET", "/a|b", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	pattern, err := PatternKey("/a|b")
+	assert.NoError(err)
+	key, err := CompositeKey(IPKey(""), pattern)(req)
+	assert.NoError(err)
+	assert.Equal(`10.0.0.1|/a\|b`, key)
+
+	// escaping keeps different parts from producing the same key
+	req.Header.Set("X-A", `a|`)
+	req.Header.Set("X-B", `b`)
+	k1, err := CompositeKey(HeaderKey("X-A"), HeaderKey("X-B"))(req)
+	assert.NoError(err)
+	req.Header.Set("X-A", `a`)
+	req.Header.Set("X-B", `|b`)
+	k2, err := CompositeKey(HeaderKey("X-A"), HeaderKey("X-B"))(req)
+	assert.NoError(err)
+	assert.NotEqual(k1, k2)
+
+	_, err = CompositeKey(IPKey(""), HeaderKey("X-Missing"))(req)
+	assert.Error(err)
+}
+
+func TestRateLimitMiddleware_KeyFunc(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		KeyFunc:           HeaderKey("X-Api-Token"),
+	})
+	assert.NoError(err)
+
+	serve := func(token string) int {
+		req := httptest.NewRequest("GET", "/test", nil)
+		// all customers share the same NAT egress IP
+		req.RemoteAddr = "203.0.113.1:1234"
+		if token != "" {
+			req.Header.Set("X-Api-Token", token)
+		}
+		rw := httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		return rw.Code
+	}
+
+	assert.Equal(200, serve("customer-a"))
+	assert.Equal(200, serve("customer-b"))
+	assert.Equal(429, serve("customer-a"))
+	assert.Equal(400, serve(""))
+}
+
+func TestRateLimitMiddleware_EmptyKeyRejected(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		KeyFunc:           func(r *http.Request) (string, error) { return " ", nil },
+	})
+	assert.NoError(err)
+
+	rw := httptest.NewRecorder()
+	called := false
+	middleware(rw, httptest.NewRequest("GET", "/test", nil), func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	assert.False(called)
+	assert.Equal(400, rw.Code)
+}
+
+func TestRateLimitMiddleware_RouteKeyOutsideMux(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		KeyFunc:           CompositeKey(IPKey(""), RouteKey),
+	})
+	assert.NoError(err)
+
+	// distinct paths must not hand out fresh buckets
+	for _, path := range []string{"/a", "/b"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		rw := httptest.NewRecorder()
+		called := false
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) { called = true })
+		assert.False(called)
+		assert.Equal(http.StatusBadRequest, rw.Code)
+	}
+}
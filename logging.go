@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLogSampleInterval is how often repeated events are logged.
+	defaultLogSampleInterval = time.Minute
+	// maxSampledKeys bounds the memory of the log sampler. Once this many
+	// distinct events were logged within an interval, further new events
+	// are dropped and summarized in a single line.
+	maxSampledKeys = 1000
+)
+
+// logSampler deduplicates log events. Each distinct event is logged at most
+// once per interval; the number of occurrences that were dropped in the
+// meantime is reported with the next line logged for that event. This way a
+// single abusive client produces one line per interval instead of one per
+// request.
+type logSampler struct {
+	interval time.Duration
+	maxKeys  int
+
+	mu      sync.Mutex
+	entries map[string]*sampleEntry
+	// dropped counts events that were not logged because entries was full.
+	dropped int
+	// nextPrune is the earliest time expired entries are removed again.
+	nextPrune time.Time
+}
+
+type sampleEntry struct {
+	until      time.Time
+	suppressed int
+}
+
+func newLogSampler(interval time.Duration, maxKeys int) *logSampler {
+	return &logSampler{
+		interval: interval,
+		maxKeys:  maxKeys,
+		entries:  make(map[string]*sampleEntry),
+	}
+}
+
+// allow reports whether the event identified by id should be logged at now
+// and how many occurrences of it were suppressed since it was last logged.
+func (s *logSampler) allow(id string, now time.Time) (bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.entries[id]
+	if e != nil && now.Before(e.until) {
+		e.suppressed++
+		return false, 0
+	}
+	if e == nil {
+		if len(s.entries) >= s.maxKeys {
+			s.prune(now)
+		}
+		if len(s.entries) >= s.maxKeys {
+			s.dropped++
+			return false, 0
+		}
+		e = &sampleEntry{}
+		s.entries[id] = e
+	}
+
+	suppressed := e.suppressed
+	e.until = now.Add(s.interval)
+	e.suppressed = 0
+	return true, suppressed
+}
+
+// takeDropped returns and resets the number of events dropped because too
+// many distinct events were logged, once the sampler has room again.
+func (s *logSampler) takeDropped(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dropped == 0 {
+		return 0
+	}
+	if len(s.entries) >= s.maxKeys {
+		s.prune(now)
+	}
+	if len(s.entries) >= s.maxKeys {
+		return 0
+	}
+	dropped := s.dropped
+	s.dropped = 0
+	return dropped
+}
+
+// prune removes entries whose interval has passed. It runs at most once per
+// interval so that a full sampler does not scan its entries on every event.
+// Dropping an entry also drops its suppressed count; entries are only
+// removed after a full interval without being logged, so that count is
+// small compared to what was already logged.
+func (s *logSampler) prune(now time.Time) {
+	if now.Before(s.nextPrune) {
+		return
+	}
+	s.nextPrune = now.Add(s.interval)
+	for id, e := range s.entries {
+		if !now.Before(e.until) {
+			delete(s.entries, id)
+		}
+	}
+}
+
+// logEvent logs msg for the given reason and key through the limiter's
+// logger. ctx is passed to the handler, so that it can add the trace or
+// request ID of the request. Repeated events for the same reason and key
+// are sampled.
+func (rl *RateLimiter) logEvent(ctx context.Context, level slog.Level, msg, reason, key string, attrs ...slog.Attr) {
+	if !rl.logger.Enabled(ctx, level) {
+		return
+	}
+
+	if rl.logSampler != nil {
+		now := time.Now()
+		ok, suppressed := rl.logSampler.allow(reason+"\x00"+key, now)
+		if dropped := rl.logSampler.takeDropped(now); dropped > 0 {
+			rl.logger.LogAttrs(ctx, slog.LevelWarn, "rate limiter log events dropped",
+				slog.Int("dropped", dropped))
+		}
+		if !ok {
+			return
+		}
+		if suppressed > 0 {
+			attrs = append(attrs, slog.Int("suppressed", suppressed))
+		}
+	}
+
+	attrs = append([]slog.Attr{slog.String("reason", reason), slog.String("key", key)}, attrs...)
+	rl.logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// logRejection logs why a request for key was rejected. ctx is the context
+// of the request; err is the store error for ReasonStoreError.
+func (rl *RateLimiter) logRejection(ctx context.Context, reason, key string, res Result, err error, attrs ...slog.Attr) {
+	attrs = append(attrs, slog.String("policy", res.Policy), slog.Int("limit", res.Limit), slog.Int("remaining", res.Remaining))
+	switch reason {
+	case ReasonRate:
+		rl.logEvent(ctx, slog.LevelInfo, "rate limit exceeded", reason, key, attrs...)
+	case ReasonMaxClients:
+		rl.logEvent(ctx, slog.LevelWarn, "rate limiter store is full; rejecting new key", reason, key, attrs...)
+	case ReasonNoKey:
+		rl.logEvent(ctx, slog.LevelWarn, "could not determine rate limit key; rejecting request", reason, key, attrs...)
+	case ReasonCost:
+		rl.logEvent(ctx, slog.LevelWarn, "request cost exceeds rate limit capacity", reason, key, attrs...)
+	case ReasonClosed:
+		rl.logEvent(ctx, slog.LevelWarn, "rate limiter is closed; rejecting request", reason, key, attrs...)
+	default:
+		attrs = append(attrs, slog.Any("error", err))
+		rl.logEvent(ctx, slog.LevelError, "rate limiter store failed", reason, key, attrs...)
+	}
+}
@@ -0,0 +1,164 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestLogSampler_SuppressesRepeatedEvents(t *testing.T) {
+	assert := a.New(t)
+	s := newLogSampler(time.Minute, 10)
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ok, suppressed := s.allow("rate\x00a", now)
+	assert.True(ok)
+	assert.Equal(0, suppressed)
+
+	for i := 0; i < 3; i++ {
+		ok, _ = s.allow("rate\x00a", now.Add(time.Second))
+		assert.False(ok)
+	}
+
+	// other events are sampled independently
+	ok, _ = s.allow("rate\x00b", now.Add(time.Second))
+	assert.True(ok)
+
+	// the next line after the interval carries the suppressed count
+	ok, suppressed = s.allow("rate\x00a", now.Add(time.Minute))
+	assert.True(ok)
+	assert.Equal(3, suppressed)
+}
+
+func TestLogSampler_BoundsDistinctEvents(t *testing.T) {
+	assert := a.New(t)
+	s := newLogSampler(time.Minute, 2)
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ok, _ := s.allow("a", now)
+	assert.True(ok)
+	ok, _ = s.allow("b", now)
+	assert.True(ok)
+	ok, _ = s.allow("c", now)
+	assert.False(ok)
+	ok, _ = s.allow("d", now)
+	assert.False(ok)
+	assert.Equal(0, s.takeDropped(now))
+
+	// once the entries expire there is room again and the drops are reported
+	assert.Equal(2, s.takeDropped(now.Add(time.Minute)))
+	assert.Equal(0, s.takeDropped(now.Add(time.Minute)))
+	ok, _ = s.allow("c", now.Add(time.Minute))
+	assert.True(ok)
+}
+
+func TestRateLimitMiddleware_StructuredLogging(t *testing.T) {
+	assert := a.New(t)
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		Logger:            logger,
+	})
+	assert.NoError(err)
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/orders", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		middleware(httptest.NewRecorder(), req, func(w http.ResponseWriter, r *http.Request) {})
+	}
+
+	// four rejections of the same client produce a single line
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(lines, 1) {
+		var entry map[string]any
+		assert.NoError(json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal("INFO", entry["level"])
+		assert.Equal("rate limit exceeded", entry["msg"])
+		assert.Equal("rate", entry["reason"])
+		assert.Equal("192.0.2.1", entry["key"])
+		assert.Equal("/orders", entry["path"])
+		assert.Equal(float64(1), entry["limit"])
+		assert.Equal(float64(0), entry["remaining"])
+	}
+}
+
+func TestRateLimitMiddleware_LoggingWithoutSampling(t *testing.T) {
+	assert := a.New(t)
+
+	var buf bytes.Buffer
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute:  1,
+		Context:            context.Background(),
+		Logger:             slog.New(slog.NewJSONHandler(&buf, nil)),
+		LogSampleInterval:  -1,
+		TrustedProxyHeader: "X-Forwarded-For",
+	})
+	assert.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/orders", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rw := httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		assert.Equal(http.StatusBadRequest, rw.Code)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(lines, 3) {
+		var entry map[string]any
+		assert.NoError(json.Unmarshal([]byte(lines[0]), &entry))
+		assert.Equal("WARN", entry["level"])
+		assert.Equal("no-key", entry["reason"])
+		assert.Equal("192.0.2.1:1234", entry["remote_addr"])
+		assert.Equal("could not determine client IP", entry["error"])
+	}
+}
+
+// requestIDHandler records the request ID found in the context of every
+// record.
+type requestIDHandler struct {
+	slog.Handler
+	ids *[]any
+}
+
+func (h requestIDHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	*h.ids = append(*h.ids, ctx.Value(ctxKey{}))
+	return nil
+}
+
+func TestRateLimitMiddleware_LogsWithRequestContext(t *testing.T) {
+	assert := a.New(t)
+
+	var ids []any
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		Logger:            slog.New(requestIDHandler{Handler: slog.DiscardHandler, ids: &ids}),
+		LogSampleInterval: -1,
+	})
+	assert.NoError(err)
+
+	for _, id := range []string{"first", "second"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, id))
+		req.RemoteAddr = "192.0.2.1:1234"
+		middleware(httptest.NewRecorder(), req, func(w http.ResponseWriter, r *http.Request) {})
+	}
+	// only the second request is rejected
+	assert.Equal([]any{"second"}, ids)
+}
@@ -0,0 +1,639 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"hash/maphash"
+	"math/bits"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// MemoryStoreConfig holds configuration options for a MemoryStore.
+type MemoryStoreConfig struct {
+	// MaxKeys caps the number of keys tracked by the store. What happens to
+	// new keys once the cap is reached is decided by OverflowPolicy. A value
+	// of 0 means no cap.
+	MaxKeys int
+	// MaxMemoryBytes caps the approximate memory held by the entries of
+	// the store: their keys, their bucket state and the bookkeeping of the
+	// store, see MemoryUsage. New keys that do not fit are handled by
+	// OverflowPolicy like those beyond MaxKeys. A value of 0 means no cap.
+	MaxMemoryBytes int64
+	// OverflowPolicy decides what happens to new keys when MaxKeys or
+	// MaxMemoryBytes is reached. The default, OverflowReject, makes Take
+	// return ErrStoreFull until entries are evicted.
+	OverflowPolicy OverflowPolicy
+	// CleanupBatchSize limits the number of entries Evict inspects in a
+	// shard before it releases the lock of the shard and lets requests
+	// through. Evict still removes every stale entry. If zero, a sensible
+	// default is used.
+	CleanupBatchSize int
+	// Shards is the number of hash shards the keys are spread over, each
+	// with its own lock, rounded up to a power of two. The overflow
+	// policies pick their victim in the shard of the new key. If zero, four
+	// shards per CPU are used, up to 256, but no more than leave room for
+	// 16 keys per shard when MaxKeys is set.
+	Shards int
+}
+
+// MemoryStore is the default Store. It keeps all buckets in memory owned
+// by the current process, spread over shards by a hash of the key so that
+// requests for different keys rarely wait for the same lock.
+type MemoryStore struct {
+	shards []*memoryShard
+	seed   maphash.Seed
+	// count is the number of entries in all shards. New entries reserve
+	// their slot in it before they are inserted, so MaxKeys holds exactly
+	// even when shards insert concurrently.
+	count    atomic.Int64
+	maxKeys  int
+	overflow OverflowPolicy
+	// bytes is the estimated size of all entries, see MemoryUsage. It is
+	// reserved like count.
+	bytes    atomic.Int64
+	maxBytes int64
+	// batchSize is the number of entries Evict inspects per lock of a
+	// shard.
+	batchSize int
+}
+
+// memoryShard holds the entries of the keys that hash to it.
+type memoryShard struct {
+	mu       sync.RWMutex
+	visitors map[string]entry
+	overflow OverflowPolicy
+	// lru orders entries by last use for OverflowEvictLRU; it is guarded
+	// by lruMu. expiry holds all entries in a min-heap ordered by the time
+	// they go idle, see expiry.go; the sampling overflow policies pick
+	// random entries from it. It is guarded by mu.
+	lru    *list.List
+	lruMu  sync.Mutex
+	expiry []entry
+	// bytes points to MemoryStore.bytes, which remove releases the size
+	// of an entry from.
+	bytes *atomic.Int64
+	// Keep the locks of neighbouring shards on separate cache lines.
+	_ [64]byte
+}
+
+// maxShards caps the default number of shards.
+const maxShards = 256
+
+// minKeysPerShard is the number of keys a shard can hold at least when
+// the shard count is chosen from MaxKeys. Overflow policies pick victims
+// within a shard, so shards that are too small would evict keys that are
+// far from the least valuable ones.
+const minKeysPerShard = 16
+
+// entry is the state a MemoryStore keeps for a key: a bucket for a single
+// limit or a compositeEntry holding the buckets of several limits. Entries
+// synchronize their state themselves.
+type entry interface {
+	// meta returns the bookkeeping of the store.
+	meta() *entryMeta
+	// fill returns the share of its capacity the entry could hand out at
+	// now under the limits it was last taken with.
+	fill(now time.Time) float64
+	// activeUntil returns the time after which the entry is considered
+	// idle by Evict.
+	activeUntil() time.Time
+	// size returns the approximate number of bytes the entry occupies,
+	// not counting its key.
+	size() int64
+}
+
+// bucket is the state of a single limit: a tokenBucketEntry or gcraEntry,
+// whose state is a single word updated with compare-and-swap, or a
+// Visitor for the window algorithms.
+type bucket interface {
+	entry
+	// holds reports whether the bucket can keep the state of limit. A
+	// bucket that cannot is replaced, discarding its state.
+	holds(limit Limit) bool
+	// take removes n tokens if available.
+	take(limit Limit, n int, now time.Time) TakeResult
+	// reserve removes n tokens if they are available within maxWait.
+	reserve(limit Limit, n int, now time.Time, maxWait time.Duration) TakeResult
+	// refund gives back n previously taken tokens.
+	refund(limit Limit, n int)
+}
+
+// entryMeta is the bookkeeping a MemoryStore keeps for every entry. It is
+// guarded by the mu of its shard (and lruMu for elem).
+type entryMeta struct {
+	key  string
+	elem *list.Element
+	// index is the position of the entry in the expiry heap, expires the
+	// time in Unix nanoseconds after which it was last known to be idle.
+	index   int
+	expires int64
+	// cost is the number of bytes the entry was charged when it was
+	// inserted, see MemoryStore.cost.
+	cost int64
+	// lastSeen is the time of the last Take in Unix nanoseconds, used by
+	// OverflowEvictRandomTwo.
+	lastSeen atomic.Int64
+}
+
+func (m *entryMeta) meta() *entryMeta {
+	return m
+}
+
+// Visitor represents a client's rate limiting state under the sliding
+// window and sliding log algorithms. Their state does not fit into a single
+// word, so it is guarded by mu.
+type Visitor struct {
+	entryMeta
+	mu sync.Mutex
+	// limit is the limit the state was last taken with. Its Algorithm
+	// selects the meaning of the fields below. The overflow policies score
+	// the entry against it rather than against the limit of the request
+	// that needs room.
+	limit Limit
+	// Sliding window: the requests counted in the current window and the
+	// start of that window.
+	tokens    int
+	lastToken time.Time
+	// prev is the number of requests counted in the previous sliding window.
+	prev int
+	// log holds the request times of a sliding log. lastToken is the time
+	// the newest entry leaves the window.
+	log *slidingLog
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore(cfg MemoryStoreConfig) *MemoryStore {
+	s := &MemoryStore{
+		seed:      maphash.MakeSeed(),
+		maxKeys:   cfg.MaxKeys,
+		maxBytes:  cfg.MaxMemoryBytes,
+		overflow:  cfg.OverflowPolicy,
+		batchSize: 100, // default inspect 100 entries per shard lock
+	}
+	if cfg.CleanupBatchSize > 0 {
+		s.batchSize = cfg.CleanupBatchSize
+	}
+	s.shards = make([]*memoryShard, shardCount(cfg))
+	for i := range s.shards {
+		s.shards[i] = &memoryShard{
+			visitors: make(map[string]entry),
+			overflow: cfg.OverflowPolicy,
+			lru:      newLRU(cfg.OverflowPolicy),
+			bytes:    &s.bytes,
+		}
+	}
+	return s
+}
+
+// shardCount returns the number of shards for cfg, a power of two.
+func shardCount(cfg MemoryStoreConfig) int {
+	n := cfg.Shards
+	if n <= 0 {
+		n = min(4*runtime.GOMAXPROCS(0), maxShards)
+		if cfg.MaxKeys > 0 {
+			n = min(n, max(cfg.MaxKeys/minKeysPerShard, 1))
+		}
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// shard returns the shard of key.
+func (s *MemoryStore) shard(key string) *memoryShard {
+	return s.shards[maphash.String(s.seed, key)&uint64(len(s.shards)-1)]
+}
+
+// load returns the entry stored under key or nil.
+func (s *MemoryStore) load(key string) entry {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.visitors[key]
+}
+
+// Supports implements AlgorithmSupporter. All algorithms are supported.
+func (s *MemoryStore) Supports(alg Algorithm) bool {
+	return alg.valid()
+}
+
+// Take implements Store.
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit, n int, now time.Time) (TakeResult, error) {
+	if err := limit.validate(); err != nil {
+		return TakeResult{}, err
+	}
+
+	b, err := s.bucket(key, limit, n, now)
+	if err != nil {
+		return TakeResult{}, err
+	}
+	if b == nil {
+		return TakeResult{Remaining: limit.Capacity}, nil
+	}
+	return b.take(limit, n, now), nil
+}
+
+// TakeAll implements MultiTaker. The buckets of several limits are kept in
+// a single entry and updated under its lock; a single limit uses the same
+// entry as Take.
+func (s *MemoryStore) TakeAll(ctx context.Context, key string, limits []Limit, n int, now time.Time) ([]TakeResult, error) {
+	return s.takeAll(key, limits, n, now, func(b bucket, limit Limit) TakeResult {
+		return b.take(limit, n, now)
+	})
+}
+
+// Reserve implements Reserver for the TokenBucket and GCRA algorithms.
+// Reserved tokens leave the bucket below zero until they are refilled.
+func (s *MemoryStore) Reserve(_ context.Context, key string, limits []Limit, n int, now time.Time, maxWait time.Duration) ([]TakeResult, error) {
+	for _, limit := range limits {
+		if limit.Algorithm != TokenBucket && limit.Algorithm != GCRA {
+			return nil, fmt.Errorf("algorithm %s does not support reservations", limit.Algorithm)
+		}
+	}
+	return s.takeAll(key, limits, n, now, func(b bucket, limit Limit) TakeResult {
+		return b.reserve(limit, n, now, maxWait)
+	})
+}
+
+// takeAll implements TakeAll and Reserve, applying take to the bucket of
+// every limit.
+func (s *MemoryStore) takeAll(key string, limits []Limit, n int, now time.Time, take func(bucket, Limit) TakeResult) ([]TakeResult, error) {
+	if len(limits) == 0 {
+		return nil, fmt.Errorf("at least one limit is required")
+	}
+	for _, limit := range limits {
+		if err := limit.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]TakeResult, len(limits))
+	if len(limits) == 1 {
+		b, err := s.bucket(key, limits[0], n, now)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			results[0] = TakeResult{Remaining: limits[0].Capacity}
+		} else {
+			results[0] = take(b, limits[0])
+		}
+		return results, nil
+	}
+
+	satisfiable := true
+	for _, limit := range limits {
+		satisfiable = satisfiable && n <= limit.Capacity
+	}
+	e, err := s.lookup(key, now, satisfiable,
+		func(e entry) bool {
+			c, ok := e.(*compositeEntry)
+			return ok && slices.Equal(c.limits, limits)
+		},
+		func() entry { return newCompositeEntry(limits, now) })
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		for i, limit := range limits {
+			results[i] = TakeResult{Remaining: limit.Capacity}
+		}
+		return results, nil
+	}
+	e.(*compositeEntry).takeAll(results, n, take)
+	return results, nil
+}
+
+// bucket returns the bucket stored under key for limit, see lookup. A key
+// that holds the state of a different algorithm or of several limits
+// starts over.
+func (s *MemoryStore) bucket(key string, limit Limit, n int, now time.Time) (bucket, error) {
+	e, err := s.lookup(key, now, n <= limit.Capacity,
+		func(e entry) bool {
+			b, ok := e.(bucket)
+			return ok && b.holds(limit)
+		},
+		func() entry { return newBucket(limit, now) })
+	if e == nil {
+		return nil, err
+	}
+	return e.(bucket), nil
+}
+
+// lookup returns the entry stored under key and marks it as used at now.
+// For unknown keys and for keys whose entry does not fit, the entry
+// returned by create is stored instead, unless the request is not
+// satisfiable because it asks for more tokens than a limit holds: such a
+// request must not allocate an entry, so lookup returns nil instead.
+func (s *MemoryStore) lookup(key string, now time.Time, satisfiable bool, fits func(entry) bool, create func() entry) (entry, error) {
+	sh := s.shard(key)
+	// Fast path: read-lock to locate visitor without blocking other readers
+	sh.mu.RLock()
+	e := sh.visitors[key]
+	sh.mu.RUnlock()
+
+	if e == nil || !fits(e) {
+		// Need to create an entry; upgrade to write lock. Double-check after locking.
+		sh.mu.Lock()
+		e = sh.visitors[key]
+		if e == nil || !fits(e) {
+			if !satisfiable {
+				sh.mu.Unlock()
+				return nil, nil
+			}
+			old := e
+			e = create()
+			cost := s.cost(key, e)
+			if old != nil {
+				// The key is used with different limits, which start
+				// over in its slot.
+				sh.remove(old)
+			}
+			if !s.reserve(sh, now, cost, old == nil) {
+				if old != nil {
+					// The key lost its entry and gives up its slot.
+					s.count.Add(-1)
+				}
+				sh.mu.Unlock()
+				return nil, ErrStoreFull
+			}
+			e.meta().cost = cost
+			sh.insert(key, e)
+		}
+		sh.mu.Unlock()
+	}
+
+	sh.touch(e)
+	e.meta().lastSeen.Store(now.UnixNano())
+	return e, nil
+}
+
+// entryOverhead approximates the bytes a MemoryStore needs for an entry
+// besides its key and the entry itself: its slot in the map of the shard,
+// holding the key header and the interface value, and in the expiry heap.
+const entryOverhead = 64
+
+// cost returns the number of bytes charged for storing e under key.
+func (s *MemoryStore) cost(key string, e entry) int64 {
+	cost := int64(len(key)) + e.size() + entryOverhead
+	if s.overflow == OverflowEvictLRU {
+		cost += int64(unsafe.Sizeof(list.Element{}))
+	}
+	return cost
+}
+
+// MemoryUsage returns the approximate number of bytes held by the entries
+// of s: their keys, their bucket state and the bookkeeping of the store.
+// This is what MaxMemoryBytes limits.
+func (s *MemoryStore) MemoryUsage() int64 {
+	return s.bytes.Load()
+}
+
+// newBucket returns the initial state of limit.
+func newBucket(limit Limit, now time.Time) bucket {
+	switch limit.Algorithm {
+	case TokenBucket:
+		return newTokenBucketEntry(limit, now)
+	case GCRA:
+		return newGCRAEntry(limit, now)
+	}
+	v := &Visitor{}
+	v.reset(limit, now)
+	return v
+}
+
+// compositeEntry keeps the buckets of all limits of a key enforced by a
+// composite rate limiter. They are only updated under mu, so a take is
+// either applied to all of them or to none.
+type compositeEntry struct {
+	entryMeta
+	mu      sync.Mutex
+	limits  []Limit
+	buckets []bucket
+}
+
+func newCompositeEntry(limits []Limit, now time.Time) *compositeEntry {
+	c := &compositeEntry{
+		limits:  slices.Clone(limits),
+		buckets: make([]bucket, len(limits)),
+	}
+	for i, limit := range limits {
+		c.buckets[i] = newBucket(limit, now)
+	}
+	return c
+}
+
+// takeAll applies take to every bucket and stores the outcomes in results.
+// If a limit rejects the take, the tokens removed from the other buckets
+// are given back before mu is released, so no other caller sees them
+// taken.
+func (c *compositeEntry) takeAll(results []TakeResult, n int, take func(bucket, Limit) TakeResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	allowed := true
+	for i, b := range c.buckets {
+		results[i] = take(b, c.limits[i])
+		allowed = allowed && results[i].Allowed
+	}
+	if allowed {
+		return
+	}
+	for i, b := range c.buckets {
+		if results[i].Allowed {
+			b.refund(c.limits[i], n)
+		}
+	}
+}
+
+// refund gives back n previously taken tokens to every bucket.
+func (c *compositeEntry) refund(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, b := range c.buckets {
+		b.refund(c.limits[i], n)
+	}
+}
+
+// fill implements entry. The most restrictive limit decides.
+func (c *compositeEntry) fill(now time.Time) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fill := 1.0
+	for _, b := range c.buckets {
+		fill = min(fill, b.fill(now))
+	}
+	return fill
+}
+
+// size implements entry.
+func (c *compositeEntry) size() int64 {
+	size := int64(unsafe.Sizeof(*c)) + int64(len(c.limits))*int64(unsafe.Sizeof(Limit{}))
+	for _, b := range c.buckets {
+		// The interface value in the slice and the bucket behind it.
+		size += int64(unsafe.Sizeof(b)) + b.size()
+	}
+	return size
+}
+
+// activeUntil implements entry. The entry is idle once all of its buckets
+// are.
+func (c *compositeEntry) activeUntil() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var until time.Time
+	for _, b := range c.buckets {
+		if t := b.activeUntil(); t.After(until) {
+			until = t
+		}
+	}
+	return until
+}
+
+// holds implements bucket. A Visitor keeps the state of the window
+// algorithm it was created for. A sliding log is sized to its capacity, so
+// a different capacity needs a new entry, which is charged for its size.
+func (v *Visitor) holds(limit Limit) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if limit.Algorithm != v.limit.Algorithm {
+		return false
+	}
+	return limit.Algorithm != SlidingLog || limit.Capacity == v.limit.Capacity
+}
+
+// activeUntil implements entry.
+func (v *Visitor) activeUntil() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.lastToken
+}
+
+// size implements entry.
+func (v *Visitor) size() int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	size := int64(unsafe.Sizeof(*v))
+	if v.log != nil {
+		size += int64(unsafe.Sizeof(*v.log)) + int64(cap(v.log.times))*8
+	}
+	return size
+}
+
+// reset puts v into the initial state of limit.Algorithm, an empty window.
+// The caller must hold v.mu or own v exclusively.
+func (v *Visitor) reset(limit Limit, now time.Time) {
+	v.limit = limit
+	v.lastToken = now
+	v.prev = 0
+	v.log = nil
+	v.tokens = 0
+	if limit.Algorithm == SlidingLog {
+		v.log = &slidingLog{times: make([]int64, limit.Capacity)}
+	}
+}
+
+// take implements bucket.
+func (v *Visitor) take(limit Limit, n int, now time.Time) TakeResult {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.limit = limit
+	if limit.Algorithm == SlidingLog {
+		return v.takeSlidingLog(limit, n, now)
+	}
+	return v.takeSlidingWindow(limit, n, now)
+}
+
+// reserve implements bucket. The window algorithms cannot hand out future
+// requests, and MemoryStore.Reserve rejects them, so only what is
+// available now is taken.
+func (v *Visitor) reserve(limit Limit, n int, now time.Time, _ time.Duration) TakeResult {
+	return v.take(limit, n, now)
+}
+
+// fill implements entry.
+func (v *Visitor) fill(now time.Time) float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return float64(v.available(now)) / float64(v.limit.Capacity)
+}
+
+// available returns the number of tokens v could hand out at now under the
+// limit it was last taken with, without modifying it. The caller must hold
+// v.mu.
+func (v *Visitor) available(now time.Time) int {
+	if v.limit.Algorithm == SlidingLog {
+		return v.slidingLogAvailable(v.limit, now)
+	}
+	return v.slidingWindowAvailable(v.limit, now)
+}
+
+// Refill implements Store.
+func (s *MemoryStore) Refill(_ context.Context, key string, limit Limit, n int) error {
+	b, _ := s.load(key).(bucket)
+	if b == nil {
+		return nil
+	}
+	b.refund(limit, n)
+	return nil
+}
+
+// RefillAll implements MultiTaker.
+func (s *MemoryStore) RefillAll(ctx context.Context, key string, limits []Limit, n int) error {
+	if len(limits) == 1 {
+		return s.Refill(ctx, key, limits[0], n)
+	}
+	c, _ := s.load(key).(*compositeEntry)
+	if c == nil || !slices.Equal(c.limits, limits) {
+		return nil
+	}
+	c.refund(n)
+	return nil
+}
+
+// refund implements bucket. Tokens taken under a different algorithm are
+// not returned.
+func (v *Visitor) refund(limit Limit, n int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.limit.Algorithm != limit.Algorithm {
+		return
+	}
+	if limit.Algorithm == SlidingLog {
+		v.refundSlidingLog(n)
+		return
+	}
+	v.tokens = max(v.tokens-n, 0)
+}
+
+// Evict implements Store. It removes every entry idle since before cutoff
+// and only inspects entries that may be: each shard keeps its entries in a
+// heap ordered by the time they go idle.
+func (s *MemoryStore) Evict(ctx context.Context, cutoff time.Time) (int, error) {
+	_, evicted, err := s.evictScan(ctx, cutoff)
+	return evicted, err
+}
+
+// evictScan implements Evict and also reports the number of entries that
+// were inspected.
+func (s *MemoryStore) evictScan(_ context.Context, cutoff time.Time) (int, int, error) {
+	scanned, evicted := 0, 0
+	for _, sh := range s.shards {
+		n, e := sh.evictStale(cutoff.UnixNano(), s.batchSize)
+		s.count.Add(-int64(e))
+		scanned += n
+		evicted += e
+	}
+	return scanned, evicted, nil
+}
+
+// Len implements Store.
+func (s *MemoryStore) Len(_ context.Context) (int, error) {
+	return int(s.count.Load()), nil
+}
@@ -0,0 +1,390 @@
+package ratelimit_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+
+	ratelimit "github.com/stfsy/go-rate-limit"
+	"github.com/stfsy/go-rate-limit/storetest"
+)
+
+func TestMemoryStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) ratelimit.Store {
+		return ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	})
+}
+
+func TestMemoryStore_MaxKeys(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxKeys: 1})
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 2}
+	now := time.Now()
+
+	_, err := s.Take(context.Background(), "a", limit, 1, now)
+	assert.NoError(err)
+
+	_, err = s.Take(context.Background(), "b", limit, 1, now)
+	assert.ErrorIs(err, ratelimit.ErrStoreFull)
+
+	// existing keys are still served
+	res, err := s.Take(context.Background(), "a", limit, 1, now)
+	assert.NoError(err)
+	assert.True(res.Allowed)
+}
+
+func TestMemoryStore_EvictRemovesAllStaleEntries(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{CleanupBatchSize: 2})
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 2}
+	now := time.Now()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		_, err := s.Take(context.Background(), key, limit, 1, now)
+		assert.NoError(err)
+	}
+	// f and g are used later and stay
+	for _, key := range []string{"f", "g"} {
+		_, err := s.Take(context.Background(), key, limit, 1, now.Add(time.Hour))
+		assert.NoError(err)
+	}
+
+	evicted, err := s.Evict(context.Background(), now.Add(time.Minute))
+	assert.NoError(err)
+	assert.Equal(5, evicted, "batches only bound how long a shard stays locked")
+	n, err := s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(2, n)
+}
+
+func TestMemoryStore_OverflowPoliciesConformance(t *testing.T) {
+	for _, p := range []ratelimit.OverflowPolicy{ratelimit.OverflowEvictLRU, ratelimit.OverflowEvictMostTokens, ratelimit.OverflowEvictRandomTwo} {
+		t.Run(p.String(), func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) ratelimit.Store {
+				return ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxKeys: 1000, OverflowPolicy: p})
+			})
+		})
+	}
+}
+
+// remaining takes a token for key and returns the tokens left afterwards.
+// A key that was evicted starts over with a full bucket.
+func remaining(t *testing.T, s ratelimit.Store, key string, limit ratelimit.Limit, n int, now time.Time) int {
+	res, err := s.Take(context.Background(), key, limit, n, now)
+	a.NoError(t, err)
+	return res.Remaining
+}
+
+func TestMemoryStore_OverflowEvictLRU(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxKeys: 2, OverflowPolicy: ratelimit.OverflowEvictLRU})
+	limit := ratelimit.Limit{Rate: time.Minute, Capacity: 3}
+	now := time.Now()
+
+	remaining(t, s, "a", limit, 1, now)
+	remaining(t, s, "b", limit, 1, now)
+	remaining(t, s, "a", limit, 1, now)
+
+	// b is the least recently used key and makes room for c
+	assert.Equal(2, remaining(t, s, "c", limit, 1, now))
+	assert.Equal(0, remaining(t, s, "a", limit, 1, now), "a was kept")
+	assert.Equal(2, remaining(t, s, "b", limit, 1, now), "b starts over")
+
+	n, err := s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(2, n)
+}
+
+func TestMemoryStore_OverflowEvictMostTokens(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxKeys: 2, OverflowPolicy: ratelimit.OverflowEvictMostTokens})
+	limit := ratelimit.Limit{Rate: time.Minute, Capacity: 3}
+	now := time.Now()
+
+	remaining(t, s, "busy", limit, 3, now)
+	remaining(t, s, "idle", limit, 1, now)
+
+	// the idle client holds the most tokens and is evicted
+	assert.Equal(2, remaining(t, s, "new", limit, 1, now))
+	res, err := s.Take(context.Background(), "busy", limit, 1, now)
+	assert.NoError(err)
+	assert.False(res.Allowed, "the busy client must not get a fresh bucket")
+}
+
+func TestMemoryStore_OverflowEvictMostTokensScoresOwnLimit(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxKeys: 2, OverflowPolicy: ratelimit.OverflowEvictMostTokens})
+	strict := ratelimit.Limit{Rate: time.Minute, Capacity: 2, Algorithm: ratelimit.GCRA}
+	loose := ratelimit.Limit{Rate: time.Minute, Capacity: 100}
+	now := time.Now()
+
+	// busy has used up its strict limit; idle has used 10% of its loose one
+	remaining(t, s, "busy", strict, 2, now)
+	remaining(t, s, "idle", loose, 10, now)
+
+	// entries are scored against the limit they were taken with, not
+	// against the limit of the new key
+	remaining(t, s, "new", loose, 1, now)
+	res, err := s.Take(context.Background(), "busy", strict, 1, now)
+	assert.NoError(err)
+	assert.False(res.Allowed, "the busy client must not get a fresh bucket")
+	assert.Equal(99, remaining(t, s, "idle", loose, 1, now), "idle starts over")
+}
+
+func TestMemoryStore_OverflowEvictRandomTwo(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxKeys: 2, OverflowPolicy: ratelimit.OverflowEvictRandomTwo})
+	limit := ratelimit.Limit{Rate: time.Minute, Capacity: 3}
+	now := time.Now()
+
+	remaining(t, s, "old", limit, 1, now)
+	remaining(t, s, "recent", limit, 1, now.Add(time.Second))
+
+	// with two keys both are compared and the older one is evicted
+	remaining(t, s, "new", limit, 1, now.Add(2*time.Second))
+	assert.Equal(1, remaining(t, s, "recent", limit, 1, now.Add(3*time.Second)))
+
+	n, err := s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(2, n)
+}
+
+func TestMemoryStore_OverflowConcurrent(t *testing.T) {
+	for _, p := range []ratelimit.OverflowPolicy{ratelimit.OverflowEvictLRU, ratelimit.OverflowEvictMostTokens, ratelimit.OverflowEvictRandomTwo} {
+		t.Run(p.String(), func(t *testing.T) {
+			assert := a.New(t)
+			s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxKeys: 10, OverflowPolicy: p, CleanupBatchSize: 5})
+			limit := ratelimit.Limit{Rate: time.Millisecond, Capacity: 3}
+			now := time.Now()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 50; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 20; j++ {
+						_, err := s.Take(context.Background(), strconv.Itoa((i+j)%40), limit, 1, now)
+						assert.NoError(err)
+						if j%5 == 0 {
+							_, err = s.Evict(context.Background(), now.Add(time.Second))
+							assert.NoError(err)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			n, err := s.Len(context.Background())
+			assert.NoError(err)
+			assert.LessOrEqual(n, 10)
+
+			// every evicted entry gave back the bytes it was charged
+			_, err = s.Evict(context.Background(), now.Add(time.Hour))
+			assert.NoError(err)
+			assert.Zero(s.MemoryUsage())
+		})
+	}
+}
+
+func TestMemoryStore_ShardsShareMaxKeys(t *testing.T) {
+	for _, p := range []ratelimit.OverflowPolicy{ratelimit.OverflowReject, ratelimit.OverflowEvictLRU, ratelimit.OverflowEvictMostTokens, ratelimit.OverflowEvictRandomTwo} {
+		t.Run(p.String(), func(t *testing.T) {
+			assert := a.New(t)
+			s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxKeys: 20, OverflowPolicy: p, Shards: 16})
+			limit := ratelimit.Limit{Rate: time.Minute, Capacity: 3}
+			now := time.Now()
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						_, err := s.Take(context.Background(), strconv.Itoa(i*10+j), limit, 1, now)
+						if p == ratelimit.OverflowReject && err != nil {
+							assert.ErrorIs(err, ratelimit.ErrStoreFull)
+						} else {
+							assert.NoError(err)
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			// the cap is shared by all shards and reached exactly
+			n, err := s.Len(context.Background())
+			assert.NoError(err)
+			assert.Equal(20, n)
+		})
+	}
+}
+
+func TestMemoryStore_EvictKeepsEntriesInUse(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{Shards: 8})
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 2}
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		_, err := s.Take(context.Background(), strconv.Itoa(i), limit, 1, now)
+		assert.NoError(err)
+	}
+	// every other key is used again after it was scheduled for expiry
+	for i := 0; i < 100; i += 2 {
+		_, err := s.Take(context.Background(), strconv.Itoa(i), limit, 1, now.Add(time.Minute))
+		assert.NoError(err)
+	}
+
+	evicted, err := s.Evict(context.Background(), now.Add(30*time.Second))
+	assert.NoError(err)
+	assert.Equal(50, evicted)
+	evicted, err = s.Evict(context.Background(), now.Add(90*time.Second))
+	assert.NoError(err)
+	assert.Equal(50, evicted)
+	n, err := s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(0, n)
+}
+
+// entryCost returns the bytes a MemoryStore charges for a single key.
+func entryCost(t *testing.T, cfg ratelimit.MemoryStoreConfig, key string, limit ratelimit.Limit) int64 {
+	s := ratelimit.NewMemoryStore(cfg)
+	remaining(t, s, key, limit, 1, time.Now())
+	return s.MemoryUsage()
+}
+
+func TestMemoryStore_MemoryUsage(t *testing.T) {
+	assert := a.New(t)
+
+	cfg := ratelimit.MemoryStoreConfig{}
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 2}
+	cost := entryCost(t, cfg, "a", limit)
+	assert.Greater(cost, int64(1))
+
+	// the key is part of the cost
+	assert.Equal(cost+99, entryCost(t, cfg, strings.Repeat("a", 100), limit))
+	// so is the state: a sliding log keeps one timestamp per request
+	small := entryCost(t, cfg, "a", ratelimit.Limit{Rate: time.Second, Capacity: 2, Algorithm: ratelimit.SlidingLog})
+	large := entryCost(t, cfg, "a", ratelimit.Limit{Rate: time.Second, Capacity: 102, Algorithm: ratelimit.SlidingLog})
+	assert.Equal(small+800, large)
+
+	s := ratelimit.NewMemoryStore(cfg)
+	now := time.Now()
+	remaining(t, s, "a", limit, 1, now)
+	remaining(t, s, "b", limit, 1, now)
+	assert.Equal(2*cost, s.MemoryUsage())
+
+	// a key used with a different limit is charged for its new entry
+	remaining(t, s, "a", ratelimit.Limit{Rate: time.Second, Capacity: 102, Algorithm: ratelimit.SlidingLog}, 1, now)
+	assert.Equal(cost+large, s.MemoryUsage())
+
+	_, err := s.Evict(context.Background(), now.Add(time.Hour))
+	assert.NoError(err)
+	assert.Zero(s.MemoryUsage())
+}
+
+func TestMemoryStore_MaxMemoryBytes(t *testing.T) {
+	assert := a.New(t)
+
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 2}
+	cost := entryCost(t, ratelimit.MemoryStoreConfig{}, "a", limit)
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxMemoryBytes: 2*cost + 10})
+	now := time.Now()
+
+	remaining(t, s, "a", limit, 1, now)
+	remaining(t, s, "b", limit, 1, now)
+	_, err := s.Take(context.Background(), "c", limit, 1, now)
+	assert.ErrorIs(err, ratelimit.ErrStoreFull)
+	assert.Equal(2*cost, s.MemoryUsage())
+
+	// a short key still fits into the remaining bytes, a long one does not
+	_, err = s.Take(context.Background(), strings.Repeat("c", 12), limit, 1, now)
+	assert.ErrorIs(err, ratelimit.ErrStoreFull)
+
+	// existing keys are still served
+	res, err := s.Take(context.Background(), "a", limit, 1, now)
+	assert.NoError(err)
+	assert.True(res.Allowed)
+}
+
+func TestMemoryStore_MaxMemoryBytesChargesChangedLimits(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{MaxMemoryBytes: 1000})
+	now := time.Now()
+	remaining(t, s, "window", ratelimit.Limit{Rate: time.Second, Capacity: 5, Algorithm: ratelimit.SlidingWindow}, 1, now)
+	remaining(t, s, "log", ratelimit.Limit{Rate: time.Second, Capacity: 5, Algorithm: ratelimit.SlidingLog}, 1, now)
+
+	// neither a switch of algorithm nor a larger log grows an entry in
+	// place: the new entry is charged and does not fit
+	large := ratelimit.Limit{Rate: time.Millisecond, Capacity: 10000, Algorithm: ratelimit.SlidingLog}
+	for _, key := range []string{"window", "log"} {
+		_, err := s.Take(context.Background(), key, large, 1, now)
+		assert.ErrorIs(err, ratelimit.ErrStoreFull, key)
+		assert.LessOrEqual(s.MemoryUsage(), int64(1000), key)
+	}
+	assert.Equal(2, remaining(t, s, "new", ratelimit.Limit{Rate: time.Second, Capacity: 3, Algorithm: ratelimit.SlidingLog}, 1, now))
+}
+
+func TestMemoryStore_MaxMemoryBytesEvicts(t *testing.T) {
+	assert := a.New(t)
+
+	cfg := ratelimit.MemoryStoreConfig{OverflowPolicy: ratelimit.OverflowEvictLRU, Shards: 1}
+	limit := ratelimit.Limit{Rate: time.Minute, Capacity: 3}
+	cost := entryCost(t, cfg, "a", limit)
+	cfg.MaxMemoryBytes = 2*cost + 50
+	s := ratelimit.NewMemoryStore(cfg)
+	now := time.Now()
+
+	remaining(t, s, "a", limit, 1, now)
+	remaining(t, s, "b", limit, 1, now)
+	remaining(t, s, "a", limit, 1, now)
+
+	// b is the least recently used key and makes room for a longer one
+	long := strings.Repeat("c", 51)
+	assert.Equal(2, remaining(t, s, long, limit, 1, now))
+	assert.Equal(2*cost+50, s.MemoryUsage())
+	assert.Equal(0, remaining(t, s, "a", limit, 1, now), "a was kept")
+
+	// a key that exceeds the budget on its own evicts nothing
+	_, err := s.Take(context.Background(), strings.Repeat("d", int(cfg.MaxMemoryBytes)), limit, 1, now)
+	assert.ErrorIs(err, ratelimit.ErrStoreFull)
+	assert.Equal(1, remaining(t, s, long, limit, 1, now), "the long key was kept")
+}
+
+func TestMemoryStore_MaxMemoryBytesBoundsEvictionsPerKey(t *testing.T) {
+	assert := a.New(t)
+
+	cfg := ratelimit.MemoryStoreConfig{OverflowPolicy: ratelimit.OverflowEvictLRU, Shards: 1}
+	limit := ratelimit.Limit{Rate: time.Minute, Capacity: 3}
+	cost := entryCost(t, cfg, "0", limit)
+	cfg.MaxMemoryBytes = 10 * cost
+	s := ratelimit.NewMemoryStore(cfg)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		remaining(t, s, strconv.Itoa(i), limit, 1, now)
+	}
+
+	// a key worth three entries evicts three
+	remaining(t, s, strings.Repeat("a", int(2*cost)+1), limit, 1, now)
+	n, err := s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(8, n)
+
+	// a key worth eight entries is rejected after evicting four
+	_, err = s.Take(context.Background(), strings.Repeat("b", int(7*cost)+1), limit, 1, now)
+	assert.ErrorIs(err, ratelimit.ErrStoreFull)
+	n, err = s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(4, n)
+}
@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rejectReasons lists the reasons rejected requests are counted by, in the
+// order they are rendered.
+var rejectReasons = []string{ReasonRate, ReasonMaxClients, ReasonNoKey, ReasonStoreError, ReasonCost, ReasonClosed}
+
+// Metrics collects counters about the decisions and the cleanup of a rate
+// limiter and renders them in the Prometheus text exposition format. It has
+// no dependency on a Prometheus client library: mount it as an HTTP handler,
+// e.g. on "/metrics", or write it into an existing exposition with WriteTo.
+//
+// A Metrics value is attached to a single rate limiter via
+// RateLimiterConfig.Metrics. The zero value is not usable; create it with
+// NewMetrics.
+type Metrics struct {
+	allowed  atomic.Uint64
+	rejected map[string]*atomic.Uint64
+
+	cleanupRuns     atomic.Uint64
+	cleanupErrors   atomic.Uint64
+	cleanupScanned  atomic.Uint64
+	cleanupEvicted  atomic.Uint64
+	cleanupDuration atomic.Int64 // total nanoseconds
+
+	mu    sync.Mutex
+	store Store
+}
+
+// NewMetrics creates an empty Metrics collector.
+func NewMetrics() *Metrics {
+	m := &Metrics{rejected: make(map[string]*atomic.Uint64, len(rejectReasons))}
+	for _, reason := range rejectReasons {
+		m.rejected[reason] = new(atomic.Uint64)
+	}
+	return m
+}
+
+// attach binds m to the store of a rate limiter so that the number of
+// tracked visitors can be reported.
+func (m *Metrics) attach(store Store) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.store != nil {
+		return fmt.Errorf("metrics are already attached to a rate limiter")
+	}
+	m.store = store
+	return nil
+}
+
+// observe counts a decision. An empty reason means the request was allowed.
+func (m *Metrics) observe(reason string) {
+	if reason == "" {
+		m.allowed.Add(1)
+		return
+	}
+	if c := m.rejected[reason]; c != nil {
+		c.Add(1)
+	}
+}
+
+// observeCleanup counts a cleanup tick. scanned is negative when the store
+// does not report how many entries it inspected.
+func (m *Metrics) observeCleanup(scanned, evicted int, took time.Duration, err error) {
+	m.cleanupRuns.Add(1)
+	if err != nil {
+		m.cleanupErrors.Add(1)
+	}
+	if scanned > 0 {
+		m.cleanupScanned.Add(uint64(scanned))
+	}
+	if evicted > 0 {
+		m.cleanupEvicted.Add(uint64(evicted))
+	}
+	m.cleanupDuration.Add(int64(took))
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	m.write(r.Context(), &buf)
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = buf.WriteTo(rw)
+}
+
+// WriteTo writes all metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	m.write(context.Background(), &buf)
+	return buf.WriteTo(w)
+}
+
+func (m *Metrics) write(ctx context.Context, buf *bytes.Buffer) {
+	writeHeader(buf, "ratelimit_requests_allowed_total", "counter", "Requests allowed by the rate limiter.")
+	writeSample(buf, "ratelimit_requests_allowed_total", "", strconv.FormatUint(m.allowed.Load(), 10))
+
+	writeHeader(buf, "ratelimit_requests_rejected_total", "counter", "Requests rejected by the rate limiter by reason.")
+	for _, reason := range rejectReasons {
+		writeSample(buf, "ratelimit_requests_rejected_total", `reason="`+reason+`"`, strconv.FormatUint(m.rejected[reason].Load(), 10))
+	}
+
+	m.mu.Lock()
+	store := m.store
+	m.mu.Unlock()
+	if store != nil {
+		// Stores that cannot report their size leave the gauge out rather
+		// than reporting a wrong value.
+		if n, err := store.Len(ctx); err == nil {
+			writeHeader(buf, "ratelimit_visitors", "gauge", "Keys currently tracked by the rate limiter store.")
+			writeSample(buf, "ratelimit_visitors", "", strconv.Itoa(n))
+		}
+		if s, ok := store.(*MemoryStore); ok {
+			writeHeader(buf, "ratelimit_memory_bytes", "gauge", "Approximate memory held by the entries of the rate limiter store.")
+			writeSample(buf, "ratelimit_memory_bytes", "", strconv.FormatInt(s.MemoryUsage(), 10))
+		}
+	}
+
+	writeHeader(buf, "ratelimit_cleanup_runs_total", "counter", "Cleanup ticks run.")
+	writeSample(buf, "ratelimit_cleanup_runs_total", "", strconv.FormatUint(m.cleanupRuns.Load(), 10))
+	writeHeader(buf, "ratelimit_cleanup_errors_total", "counter", "Cleanup ticks that failed.")
+	writeSample(buf, "ratelimit_cleanup_errors_total", "", strconv.FormatUint(m.cleanupErrors.Load(), 10))
+	writeHeader(buf, "ratelimit_cleanup_scanned_total", "counter", "Store entries inspected by cleanup.")
+	writeSample(buf, "ratelimit_cleanup_scanned_total", "", strconv.FormatUint(m.cleanupScanned.Load(), 10))
+	writeHeader(buf, "ratelimit_cleanup_evicted_total", "counter", "Store entries evicted by cleanup.")
+	writeSample(buf, "ratelimit_cleanup_evicted_total", "", strconv.FormatUint(m.cleanupEvicted.Load(), 10))
+
+	writeHeader(buf, "ratelimit_cleanup_duration_seconds", "summary", "Time spent in cleanup ticks.")
+	seconds := time.Duration(m.cleanupDuration.Load()).Seconds()
+	writeSample(buf, "ratelimit_cleanup_duration_seconds_sum", "", strconv.FormatFloat(seconds, 'g', -1, 64))
+	writeSample(buf, "ratelimit_cleanup_duration_seconds_count", "", strconv.FormatUint(m.cleanupRuns.Load(), 10))
+}
+
+func writeHeader(buf *bytes.Buffer, name, typ, help string) {
+	buf.WriteString("# HELP " + name + " " + help + "\n")
+	buf.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func writeSample(buf *bytes.Buffer, name, labels, value string) {
+	buf.WriteString(name)
+	if labels != "" {
+		buf.WriteString("{" + labels + "}")
+	}
+	buf.WriteString(" " + value + "\n")
+}
@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_CountsDecisions(t *testing.T) {
+	assert := a.New(t)
+
+	metrics := NewMetrics()
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute:     2,
+		Context:               context.Background(),
+		MaxClientIpsPerMinute: 1,
+		KeyFunc:               HeaderKey("X-Client"),
+		Metrics:               metrics,
+	})
+	assert.NoError(err)
+
+	for _, client := range []string{"a", "a", "a", "b", ""} {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("X-Client", client)
+		middleware(httptest.NewRecorder(), req, func(w http.ResponseWriter, r *http.Request) {})
+	}
+
+	var out strings.Builder
+	_, err = metrics.WriteTo(&out)
+	assert.NoError(err)
+	assert.Contains(out.String(), "# TYPE ratelimit_requests_allowed_total counter\nratelimit_requests_allowed_total 2\n")
+	assert.Contains(out.String(), `ratelimit_requests_rejected_total{reason="rate"} 1`+"\n")
+	assert.Contains(out.String(), `ratelimit_requests_rejected_total{reason="max-clients"} 1`+"\n")
+	assert.Contains(out.String(), `ratelimit_requests_rejected_total{reason="no-key"} 1`+"\n")
+	assert.Contains(out.String(), `ratelimit_requests_rejected_total{reason="store-error"} 0`+"\n")
+	assert.Contains(out.String(), "# TYPE ratelimit_visitors gauge\nratelimit_visitors 1\n")
+	assert.Contains(out.String(), "# TYPE ratelimit_memory_bytes gauge\n")
+}
+
+func TestMetrics_CountsCleanup(t *testing.T) {
+	assert := a.New(t)
+
+	limiter, err := NewRateLimiter(context.Background(), 10)
+	assert.NoError(err)
+	limiter.store = NewMemoryStore(MemoryStoreConfig{CleanupBatchSize: 2})
+	limiter.metrics = NewMetrics()
+	assert.NoError(limiter.metrics.attach(limiter.store))
+
+	for _, key := range []string{"a", "b", "c"} {
+		limiter.Allow(key)
+	}
+	// every entry is stale
+	limiter.visitorStaleAfter.Store(int64(-time.Minute))
+	limiter.evictStale()
+	limiter.evictStale()
+
+	var out strings.Builder
+	_, err = limiter.metrics.WriteTo(&out)
+	assert.NoError(err)
+	assert.Contains(out.String(), "ratelimit_cleanup_runs_total 2\n")
+	assert.Contains(out.String(), "ratelimit_cleanup_errors_total 0\n")
+	assert.Contains(out.String(), "ratelimit_cleanup_scanned_total 3\n")
+	assert.Contains(out.String(), "ratelimit_cleanup_evicted_total 3\n")
+	assert.Contains(out.String(), "# TYPE ratelimit_cleanup_duration_seconds summary\n")
+	assert.Contains(out.String(), "ratelimit_cleanup_duration_seconds_count 2\n")
+	assert.Contains(out.String(), "ratelimit_visitors 0\n")
+}
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	assert := a.New(t)
+
+	rw := httptest.NewRecorder()
+	NewMetrics().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(http.StatusOK, rw.Code)
+	assert.Equal("text/plain; version=0.0.4; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.True(strings.HasPrefix(rw.Body.String(), "# HELP ratelimit_requests_allowed_total"))
+	// without a rate limiter there is no store to report on
+	assert.NotContains(rw.Body.String(), "ratelimit_visitors")
+}
+
+func TestMetrics_SingleRateLimiter(t *testing.T) {
+	assert := a.New(t)
+
+	metrics := NewMetrics()
+	_, err := RateLimitMiddleware(RateLimiterConfig{RequestsPerMinute: 1, Context: context.Background(), Metrics: metrics})
+	assert.NoError(err)
+	_, err = RateLimitMiddleware(RateLimiterConfig{RequestsPerMinute: 1, Context: context.Background(), Metrics: metrics})
+	assert.Error(err)
+}
+
+func TestMetrics_NotAttachedOnInvalidConfig(t *testing.T) {
+	assert := a.New(t)
+
+	metrics := NewMetrics()
+	_, err := RateLimitMiddleware(RateLimiterConfig{RequestsPerMinute: 1, Context: context.Background(), Metrics: metrics,
+		Policies: []RoutePolicy{{Name: "bad", Pattern: "GET /{", Limits: []Bandwidth{{Name: "a", Limit: Limit{Rate: time.Second, Capacity: 1}}}}}})
+	assert.Error(err)
+
+	// a corrected configuration can use the same metrics
+	_, err = RateLimitMiddleware(RateLimiterConfig{RequestsPerMinute: 1, Context: context.Background(), Metrics: metrics})
+	assert.NoError(err)
+}
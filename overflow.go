@@ -0,0 +1,233 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math/rand/v2"
+	"time"
+)
+
+// OverflowPolicy decides what a MemoryStore does with a new key once it
+// holds MaxKeys entries or MaxMemoryBytes would be exceeded. All policies
+// take constant time per request.
+type OverflowPolicy int
+
+const (
+	// OverflowReject rejects new keys with ErrStoreFull until entries are
+	// evicted by the cleanup worker. Tracked keys are never displaced, but
+	// an attacker who fills the store locks out every new client.
+	OverflowReject OverflowPolicy = iota
+	// OverflowEvictLRU evicts the least recently used key.
+	OverflowEvictLRU
+	// OverflowEvictMostTokens evicts the key with the most tokens relative
+	// to the capacity of its limit, i.e. the least active one, among a
+	// small random sample of keys. Evicting a nearly full bucket loses
+	// little: it would be full again soon anyway.
+	OverflowEvictMostTokens
+	// OverflowEvictRandomTwo picks two random keys and evicts the one that
+	// was used less recently. It approximates LRU without the bookkeeping
+	// on every request.
+	OverflowEvictRandomTwo
+)
+
+// mostTokensSamples is the number of keys inspected by
+// OverflowEvictMostTokens.
+const mostTokensSamples = 5
+
+// String returns the name of the policy.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowReject:
+		return "reject"
+	case OverflowEvictLRU:
+		return "lru"
+	case OverflowEvictMostTokens:
+		return "most-tokens"
+	case OverflowEvictRandomTwo:
+		return "random-two"
+	default:
+		return "unknown"
+	}
+}
+
+// insert adds a new entry. The caller must hold sh.mu for writing and
+// must have reserved its slot, see MemoryStore.reserve.
+func (sh *memoryShard) insert(key string, e entry) {
+	m := e.meta()
+	m.key = key
+	m.expires = e.activeUntil().UnixNano()
+	sh.visitors[key] = e
+	sh.push(e)
+	if sh.overflow == OverflowEvictLRU {
+		sh.lruMu.Lock()
+		m.elem = sh.lru.PushFront(e)
+		sh.lruMu.Unlock()
+	}
+}
+
+// remove deletes an entry and releases its bytes. Its slot stays
+// reserved; callers that free it decrement MemoryStore.count. The caller
+// must hold sh.mu for writing.
+func (sh *memoryShard) remove(e entry) {
+	v := e.meta()
+	sh.bytes.Add(-v.cost)
+	delete(sh.visitors, v.key)
+	sh.pop(v.index)
+	if sh.overflow == OverflowEvictLRU {
+		sh.lruMu.Lock()
+		sh.lru.Remove(v.elem)
+		sh.lruMu.Unlock()
+	}
+}
+
+// touch marks e as most recently used. It only takes lruMu, so callers do
+// not need to hold sh.mu.
+func (sh *memoryShard) touch(e entry) {
+	if sh.overflow != OverflowEvictLRU {
+		return
+	}
+	sh.lruMu.Lock()
+	// MoveToFront is a no-op for entries that were removed concurrently.
+	sh.lru.MoveToFront(e.meta().elem)
+	sh.lruMu.Unlock()
+}
+
+// maxOverflowEvictions is the number of entries a new entry may evict to
+// make room. Entries that need more are rejected, so a single request with
+// a large key cannot displace most of the tracked clients.
+const maxOverflowEvictions = 4
+
+// reserve reserves cost bytes and, if slot is set, a slot for a new
+// entry in sh, evicting up to maxOverflowEvictions entries according to
+// the overflow policy while the store is full, and reports whether it
+// succeeded. Nothing stays reserved if it fails. Victims are picked in sh;
+// only if sh has none are other shards tried, skipping those that are busy
+// so that shard locks are never waited for while one is held. The caller
+// must hold sh.mu for writing.
+func (s *MemoryStore) reserve(sh *memoryShard, now time.Time, cost int64, slot bool) bool {
+	if s.maxBytes > 0 && cost > s.maxBytes {
+		// Evicting every other entry would not make room.
+		return false
+	}
+	evicted := 0
+	for slot {
+		n := s.count.Load()
+		if s.maxKeys <= 0 || n < int64(s.maxKeys) {
+			if s.count.CompareAndSwap(n, n+1) {
+				break
+			}
+			continue
+		}
+		if !s.makeRoom(sh, now, &evicted) {
+			return false
+		}
+	}
+	for s.maxBytes > 0 {
+		n := s.bytes.Load()
+		if n+cost <= s.maxBytes {
+			if s.bytes.CompareAndSwap(n, n+cost) {
+				return true
+			}
+			continue
+		}
+		if !s.makeRoom(sh, now, &evicted) {
+			if slot {
+				s.count.Add(-1)
+			}
+			return false
+		}
+	}
+	s.bytes.Add(cost)
+	return true
+}
+
+// makeRoom evicts an entry for a new one and reports whether it did. It
+// does not if the overflow policy rejects new keys or the new entry has
+// already evicted maxOverflowEvictions entries. The caller must hold
+// sh.mu for writing.
+func (s *MemoryStore) makeRoom(sh *memoryShard, now time.Time, evicted *int) bool {
+	if s.overflow == OverflowReject || *evicted >= maxOverflowEvictions {
+		return false
+	}
+	*evicted++
+	return s.evictAny(sh, now)
+}
+
+// evictAny removes one entry, preferably from sh, and reports whether it
+// did. The caller must hold sh.mu for writing.
+func (s *MemoryStore) evictAny(sh *memoryShard, now time.Time) bool {
+	if sh.evictForOverflow(now) {
+		s.count.Add(-1)
+		return true
+	}
+	for _, other := range s.shards {
+		if other == sh || !other.mu.TryLock() {
+			continue
+		}
+		ok := other.evictForOverflow(now)
+		other.mu.Unlock()
+		if ok {
+			s.count.Add(-1)
+			return true
+		}
+	}
+	return false
+}
+
+// evictForOverflow removes one entry according to the overflow policy and
+// reports whether room was made. The caller must hold sh.mu for writing.
+func (sh *memoryShard) evictForOverflow(now time.Time) bool {
+	var victim entry
+	switch sh.overflow {
+	case OverflowEvictLRU:
+		sh.lruMu.Lock()
+		if back := sh.lru.Back(); back != nil {
+			victim = back.Value.(entry)
+		}
+		sh.lruMu.Unlock()
+	case OverflowEvictMostTokens:
+		best := -1.0
+		for i := 0; i < mostTokensSamples && i < len(sh.expiry); i++ {
+			// Small shards are inspected completely.
+			e := sh.expiry[i]
+			if len(sh.expiry) > mostTokensSamples {
+				e = sh.expiry[rand.IntN(len(sh.expiry))]
+			}
+			// Entries may belong to different limits, so their fill level
+			// is compared rather than the number of tokens.
+			if fill := e.fill(now); fill > best {
+				best, victim = fill, e
+			}
+		}
+	case OverflowEvictRandomTwo:
+		n := len(sh.expiry)
+		if n == 0 {
+			break
+		}
+		victim = sh.expiry[rand.IntN(n)]
+		if n > 1 {
+			// Pick a second, distinct key.
+			i, j := victim.meta().index, rand.IntN(n-1)
+			if j >= i {
+				j++
+			}
+			other := sh.expiry[j]
+			if other.meta().lastSeen.Load() < victim.meta().lastSeen.Load() {
+				victim = other
+			}
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	sh.remove(victim)
+	return true
+}
+
+// newLRU returns the list used by OverflowEvictLRU, or nil for other
+// policies.
+func newLRU(p OverflowPolicy) *list.List {
+	if p != OverflowEvictLRU {
+		return nil
+	}
+	return list.New()
+}
@@ -0,0 +1,457 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// policyFile is the schema of a policy file, see LoadPolicyFile.
+type policyFile struct {
+	Limits   []limitSpec  `json:"limits" yaml:"limits"`
+	Key      []string     `json:"key" yaml:"key"`
+	Exempt   exemptSpec   `json:"exempt" yaml:"exempt"`
+	Policies []policySpec `json:"policies" yaml:"policies"`
+}
+
+// limitSpec describes a Bandwidth. Exactly one of Rate and
+// RequestsPerMinute must be set, as in RateLimiterConfig.
+type limitSpec struct {
+	Name              string `json:"name" yaml:"name"`
+	Rate              string `json:"rate" yaml:"rate"`
+	RequestsPerMinute int    `json:"requests_per_minute" yaml:"requests_per_minute"`
+	Burst             int    `json:"burst" yaml:"burst"`
+	Algorithm         string `json:"algorithm" yaml:"algorithm"`
+}
+
+// exemptSpec lists the clients that bypass the rate limiter.
+type exemptSpec struct {
+	IPs  []string `json:"ips" yaml:"ips"`
+	Keys []string `json:"keys" yaml:"keys"`
+}
+
+// policySpec describes a RoutePolicy.
+type policySpec struct {
+	Name    string      `json:"name" yaml:"name"`
+	Pattern string      `json:"pattern" yaml:"pattern"`
+	Limits  []limitSpec `json:"limits" yaml:"limits"`
+}
+
+// LoadPolicyFile reads the limits, key, exemptions and route policies from
+// the YAML or JSON file at path and returns base with them applied. Files
+// ending in .json are read as JSON, all others as YAML. A file looks like
+// this:
+//
+//	limits:
+//	  - name: minute
+//	    requests_per_minute: 100
+//	  - name: day
+//	    rate: 8.64s
+//	    burst: 10000
+//	key: ["ip", "header:X-Tenant"]
+//	exempt:
+//	  ips: ["10.0.0.0/8"]
+//	  keys: ["internal"]
+//	policies:
+//	  - name: login
+//	    pattern: POST /login
+//	    limits:
+//	      - rate: 1m
+//	        burst: 5
+//	        algorithm: sliding-log
+//
+// A limit has a rate (a Go duration per token) and a burst, or
+// requests_per_minute and an optional burst, and an optional algorithm
+// (token-bucket, sliding-window, sliding-log or gcra). Names are optional
+// for a single limit. The limits replace RequestsPerMinute, Rate, Burst,
+// Algorithm and Limits of base; the policies replace Policies. key lists
+// the parts of the key, "ip" or "header:<Name>", and replaces KeyFunc if
+// set. exempt lists client IPs or networks and keys that are not limited
+// and replaces Exempt if set. Unknown fields and invalid values are
+// rejected. Errors name the offending field; YAML errors and JSON syntax
+// and type errors also carry the line.
+func LoadPolicyFile(path string, base RateLimiterConfig) (RateLimiterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RateLimiterConfig{}, err
+	}
+	var f policyFile
+	if err := decodePolicyFile(path, data, &f); err != nil {
+		return RateLimiterConfig{}, fmt.Errorf("policy file %s: %w", path, err)
+	}
+	cfg, err := f.apply(base)
+	if err != nil {
+		return RateLimiterConfig{}, fmt.Errorf("policy file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// decodePolicyFile decodes data into f, rejecting unknown fields.
+func decodePolicyFile(path string, data []byte, f *policyFile) error {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(f); err != nil {
+			if errors.Is(err, io.EOF) {
+				return errors.New("file is empty")
+			}
+			return jsonError(data, err)
+		}
+		if dec.More() {
+			return errors.New("unexpected data after the policy object")
+		}
+		return nil
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(f); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("file is empty")
+		}
+		return err
+	}
+	return nil
+}
+
+// jsonError adds the line to JSON errors that carry an offset;
+// encoding/json reports unknown fields without one.
+func jsonError(data []byte, err error) error {
+	var offset int64
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+	default:
+		return err
+	}
+	line := 1 + bytes.Count(data[:min(offset, int64(len(data)))], []byte("\n"))
+	return fmt.Errorf("line %d: %w", line, err)
+}
+
+// apply returns base with the settings of f.
+func (f *policyFile) apply(base RateLimiterConfig) (RateLimiterConfig, error) {
+	cfg := base
+	limits, err := bandwidths("limits", f.Limits)
+	if err != nil {
+		return RateLimiterConfig{}, err
+	}
+	cfg.RequestsPerMinute, cfg.Rate, cfg.Burst, cfg.Algorithm = 0, 0, 0, TokenBucket
+	cfg.Limits = limits
+
+	cfg.Policies = make([]RoutePolicy, len(f.Policies))
+	for i, p := range f.Policies {
+		path := fmt.Sprintf("policies[%d] %q", i, p.Name)
+		if p.Pattern == "" {
+			return RateLimiterConfig{}, fmt.Errorf("%s: pattern is required", path)
+		}
+		limits, err := bandwidths(path+": limits", p.Limits)
+		if err != nil {
+			return RateLimiterConfig{}, err
+		}
+		cfg.Policies[i] = RoutePolicy{Name: p.Name, Pattern: p.Pattern, Limits: limits}
+	}
+	// Names and patterns are checked together.
+	if _, err := newRouteTable(&RateLimiter{}, cfg.Policies); err != nil {
+		return RateLimiterConfig{}, fmt.Errorf("policies: %w", err)
+	}
+
+	header := base.proxyHeader()
+	if len(f.Key) > 0 {
+		fns := make([]KeyFunc, len(f.Key))
+		for i, k := range f.Key {
+			switch name, ok := strings.CutPrefix(k, "header:"); {
+			case k == "ip":
+				fns[i] = IPKey(header, base.TrustedProxies...)
+			case ok && strings.TrimSpace(name) != "":
+				fns[i] = HeaderKey(strings.TrimSpace(name))
+			default:
+				return RateLimiterConfig{}, fmt.Errorf("key[%d]: unknown key %q, want \"ip\" or \"header:<Name>\"", i, k)
+			}
+		}
+		cfg.KeyFunc = fns[0]
+		if len(fns) > 1 {
+			cfg.KeyFunc = CompositeKey(fns...)
+		}
+	}
+
+	if len(f.Exempt.IPs) > 0 || len(f.Exempt.Keys) > 0 {
+		exempt, err := f.Exempt.fn(IPKey(header, base.TrustedProxies...))
+		if err != nil {
+			return RateLimiterConfig{}, err
+		}
+		cfg.Exempt = exempt
+	}
+	return cfg, nil
+}
+
+// bandwidths converts specs into validated bandwidths. path locates specs
+// in the file for error messages.
+func bandwidths(path string, specs []limitSpec) ([]Bandwidth, error) {
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("%s: at least one limit is required", path)
+	}
+	out := make([]Bandwidth, len(specs))
+	for i, spec := range specs {
+		bw, err := spec.bandwidth(len(specs) == 1)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", path, i, err)
+		}
+		if err := validateBandwidths([]Bandwidth{bw}); err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", path, i, err)
+		}
+		out[i] = bw
+	}
+	if err := validateBandwidths(out); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return out, nil
+}
+
+// bandwidth returns the bandwidth described by s. The name may be omitted
+// if s is the only limit.
+func (s limitSpec) bandwidth(only bool) (Bandwidth, error) {
+	bw := Bandwidth{Name: s.Name}
+	if bw.Name == "" {
+		if !only {
+			return Bandwidth{}, errors.New("name is required when there are several limits")
+		}
+		bw.Name = defaultPolicyName
+	}
+	cfg := RateLimiterConfig{RequestsPerMinute: s.RequestsPerMinute, Burst: s.Burst}
+	if s.Rate != "" {
+		rate, err := time.ParseDuration(s.Rate)
+		if err != nil {
+			return Bandwidth{}, fmt.Errorf("rate: %w", err)
+		}
+		if rate == 0 {
+			return Bandwidth{}, fmt.Errorf("rate %s must be positive", rate)
+		}
+		cfg.Rate = rate
+	}
+	if s.Algorithm != "" {
+		alg, err := parseAlgorithm(s.Algorithm)
+		if err != nil {
+			return Bandwidth{}, fmt.Errorf("algorithm: %w", err)
+		}
+		cfg.Algorithm = alg
+	}
+	limit, err := cfg.limit()
+	if err != nil {
+		return Bandwidth{}, err
+	}
+	bw.Limit = limit
+	return bw, nil
+}
+
+// parseAlgorithm returns the algorithm whose String is name.
+func parseAlgorithm(name string) (Algorithm, error) {
+	for a := TokenBucket; a.valid(); a++ {
+		if a.String() == name {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown algorithm %q", name)
+}
+
+// fn returns an Exempt function for s. clientIP resolves the client IP of
+// a request.
+func (s exemptSpec) fn(clientIP KeyFunc) (func(r *http.Request, key string) bool, error) {
+	prefixes := make([]netip.Prefix, 0, len(s.IPs))
+	for i, v := range s.IPs {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(v)
+			if aerr != nil {
+				return nil, fmt.Errorf("exempt.ips[%d]: invalid IP or network %q", i, v)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	keys := make(map[string]bool, len(s.Keys))
+	for _, k := range s.Keys {
+		keys[k] = true
+	}
+	return func(r *http.Request, key string) bool {
+		if keys[key] {
+			return true
+		}
+		if len(prefixes) == 0 {
+			return false
+		}
+		ip, err := clientIP(r)
+		if err != nil {
+			return false
+		}
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, p := range prefixes {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// PolicyLoader serves a rate limiting middleware configured from a policy
+// file and applies changes to the file without a restart. Reloads replace
+// the limits, policies, key and exemptions; policies whose limits did not
+// change keep the state of their clients. The store, its capacity and the
+// other settings of the base configuration are fixed when the loader is
+// created. A file that fails to load is logged and the previous policies
+// stay in effect.
+type PolicyLoader struct {
+	path string
+	base RateLimiterConfig
+	m    *Middleware
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	// missing is set while the file cannot be read, so that Watch reports
+	// a missing or renamed file once rather than on every poll.
+	missing bool
+}
+
+// NewPolicyLoader loads the policy file at path on top of base, see
+// LoadPolicyFile, and creates the middleware for it.
+func NewPolicyLoader(path string, base RateLimiterConfig) (*PolicyLoader, error) {
+	l := &PolicyLoader{path: path, base: base}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := LoadPolicyFile(path, base)
+	if err != nil {
+		return nil, err
+	}
+	if l.m, err = NewMiddleware(cfg); err != nil {
+		return nil, err
+	}
+	l.modTime, l.size = fi.ModTime(), fi.Size()
+	return l, nil
+}
+
+// Middleware returns the rate limiting middleware. It always enforces the
+// policies loaded last.
+func (l *PolicyLoader) Middleware() func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	return l.m.ServeHTTP
+}
+
+// Close closes the middleware, see Middleware.Close. Cancel the context
+// passed to Watch to stop watching the file.
+func (l *PolicyLoader) Close() error {
+	return l.m.Close()
+}
+
+// MemoryUsage returns the memory held by the default store of the
+// middleware, see Middleware.MemoryUsage.
+func (l *PolicyLoader) MemoryUsage() int64 {
+	return l.m.MemoryUsage()
+}
+
+// Reload reads the policy file again and applies it. If the file is
+// invalid, the error is returned and the current policies are kept.
+func (l *PolicyLoader) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	return l.reload(fi)
+}
+
+// reload applies the policy file whose current state is fi. The caller
+// must hold l.mu.
+func (l *PolicyLoader) reload(fi os.FileInfo) error {
+	// Remember the file even if it is invalid so that a broken file is
+	// reported once rather than on every poll.
+	l.modTime, l.size = fi.ModTime(), fi.Size()
+	cfg, err := LoadPolicyFile(l.path, l.base)
+	if err != nil {
+		return err
+	}
+	return l.m.apply(cfg)
+}
+
+// Watch reloads the policy file when it changes, checking its modification
+// time and size every interval, and on SIGHUP. Failed reloads are logged.
+// It blocks until ctx is done; run it in its own goroutine.
+func (l *PolicyLoader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			l.logReload(l.Reload())
+		case <-tick:
+			if changed, err := l.reloadIfChanged(); changed || err != nil {
+				l.logReload(err)
+			}
+		}
+	}
+}
+
+// reloadIfChanged reloads the policy file if its modification time or size
+// changed since it was last read, and reports whether it did.
+func (l *PolicyLoader) reloadIfChanged() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		if l.missing {
+			return false, nil
+		}
+		l.missing = true
+		return false, err
+	}
+	l.missing = false
+	if fi.ModTime().Equal(l.modTime) && fi.Size() == l.size {
+		return false, nil
+	}
+	return true, l.reload(fi)
+}
+
+// logReload logs the outcome of a reload.
+func (l *PolicyLoader) logReload(err error) {
+	logger := l.m.limiter.logger
+	if err != nil {
+		logger.LogAttrs(context.Background(), slog.LevelError, "failed to reload rate limit policies; keeping the current ones",
+			slog.String("path", l.path), slog.Any("error", err))
+		return
+	}
+	logger.LogAttrs(context.Background(), slog.LevelInfo, "reloaded rate limit policies", slog.String("path", l.path))
+}
@@ -0,0 +1,221 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+const testPolicyFile = `
+limits:
+  - name: minute
+    requests_per_minute: 3
+key: ["ip"]
+exempt:
+  ips: ["10.0.0.0/8"]
+policies:
+  - name: login
+    pattern: POST /login
+    limits:
+      - rate: 1m
+        burst: 1
+        algorithm: sliding-log
+`
+
+func writePolicyFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func serveFrom(middleware func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc), method, path, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = remoteAddr
+	rw := httptest.NewRecorder()
+	middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+	return rw
+}
+
+func TestLoadPolicyFile(t *testing.T) {
+	assert := a.New(t)
+
+	for _, name := range []string{"policies.yaml", "policies.json"} {
+		content := testPolicyFile
+		if filepath.Ext(name) == ".json" {
+			content = `{
+	"limits": [{"name": "minute", "requests_per_minute": 3}],
+	"key": ["ip"],
+	"exempt": {"ips": ["10.0.0.0/8"]},
+	"policies": [{"name": "login", "pattern": "POST /login", "limits": [{"rate": "1m", "burst": 1, "algorithm": "sliding-log"}]}]
+}`
+		}
+		cfg, err := LoadPolicyFile(writePolicyFile(t, name, content), RateLimiterConfig{Context: context.Background(), RequestsPerMinute: 100})
+		assert.NoError(err, name)
+		assert.Equal(0, cfg.RequestsPerMinute, name)
+		assert.Equal([]Bandwidth{{Name: "minute", Limit: Limit{Rate: 20 * time.Second, Capacity: 3}}}, cfg.Limits, name)
+		assert.Equal([]RoutePolicy{{Name: "login", Pattern: "POST /login", Limits: []Bandwidth{
+			{Name: defaultPolicyName, Limit: Limit{Rate: time.Minute, Capacity: 1, Algorithm: SlidingLog}},
+		}}}, cfg.Policies, name)
+		assert.NotNil(cfg.KeyFunc, name)
+		assert.NotNil(cfg.Exempt, name)
+	}
+}
+
+func TestLoadPolicyFile_Errors(t *testing.T) {
+	tests := []struct {
+		name, file, content, err string
+	}{
+		{"empty", "p.yaml", "", "file is empty"},
+		{"unknown field", "p.yaml", "limits: []\nburst: 1\n", "field burst not found"},
+		{"unknown json field", "p.json", `{"limits": [], "burst": 1}`, `unknown field "burst"`},
+		{"json syntax", "p.json", "{\n\"limits\": [],\n}", "line 3: invalid character '}'"},
+		{"json type", "p.json", "{\n\"limits\": 1}", "line 2: json: cannot unmarshal number"},
+		{"no limits", "p.yaml", "key: [ip]\n", "limits: at least one limit is required"},
+		{"bad rate", "p.yaml", "limits: [{rate: fast, burst: 1}]\n", "limits[0]: rate: time: invalid duration"},
+		{"rate and rpm", "p.yaml", "limits: [{rate: 1s, requests_per_minute: 1}]\n", "limits[0]: only one of RequestsPerMinute and Rate can be set"},
+		{"bad algorithm", "p.yaml", "limits: [{rate: 1s, burst: 1, algorithm: leaky}]\n", `limits[0]: algorithm: unknown algorithm "leaky"`},
+		{"missing name", "p.yaml", "limits: [{rate: 1s, burst: 1}, {rate: 1m, burst: 1}]\n", "limits[0]: name is required"},
+		{"duplicate name", "p.yaml", "limits: [{name: a, rate: 1s, burst: 1}, {name: a, rate: 1m, burst: 1}]\n", `limits: duplicate limit name "a"`},
+		{"bad key", "p.yaml", "limits: [{rate: 1s, burst: 1}]\nkey: [cookie]\n", `key[0]: unknown key "cookie"`},
+		{"bad exempt ip", "p.yaml", "limits: [{rate: 1s, burst: 1}]\nexempt: {ips: [local]}\n", `exempt.ips[0]: invalid IP or network "local"`},
+		{"policy limit", "p.yaml", "limits: [{rate: 1s, burst: 1}]\npolicies: [{name: login, pattern: /login, limits: [{rate: 1s}]}]\n",
+			`policies[0] "login": limits[0]: burst must be set along with rate`},
+		{"policy pattern", "p.yaml", "limits: [{rate: 1s, burst: 1}]\npolicies: [{name: login, limits: [{rate: 1s, burst: 1}]}]\n",
+			`policies[0] "login": pattern is required`},
+		{"conflicting patterns", "p.yaml", "limits: [{rate: 1s, burst: 1}]\npolicies: [{name: a, pattern: /a, limits: [{rate: 1s, burst: 1}]}, {name: b, pattern: /a, limits: [{rate: 1s, burst: 1}]}]\n",
+			`policies: policy "b"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadPolicyFile(writePolicyFile(t, tt.file, tt.content), RateLimiterConfig{})
+			a.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestRateLimitMiddleware_Exempt(t *testing.T) {
+	assert := a.New(t)
+
+	var decisions int
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		Exempt:            func(r *http.Request, key string) bool { return key == "10.0.0.1" },
+		OnDecision:        func(r *http.Request, d Decision) { decisions++ },
+	})
+	assert.NoError(err)
+
+	for range 3 {
+		rw := serveFrom(middleware, "GET", "/", "10.0.0.1:1234")
+		assert.Equal(http.StatusOK, rw.Code)
+		assert.Empty(rw.Header().Get("RateLimit"))
+	}
+	assert.Equal(0, decisions)
+	assert.Equal(http.StatusOK, serveFrom(middleware, "GET", "/", "10.0.0.2:1234").Code)
+	assert.Equal(http.StatusTooManyRequests, serveFrom(middleware, "GET", "/", "10.0.0.2:1234").Code)
+}
+
+func TestPolicyLoader_Reload(t *testing.T) {
+	assert := a.New(t)
+
+	path := writePolicyFile(t, "policies.yaml", testPolicyFile)
+	loader, err := NewPolicyLoader(path, RateLimiterConfig{Context: context.Background()})
+	assert.NoError(err)
+	middleware := loader.Middleware()
+
+	// exempt networks are not limited
+	for range 5 {
+		assert.Equal(http.StatusOK, serveFrom(middleware, "GET", "/", "10.1.2.3:1234").Code)
+	}
+	assert.Equal(http.StatusOK, serveFrom(middleware, "POST", "/login", "192.0.2.1:1234").Code)
+	assert.Equal(http.StatusTooManyRequests, serveFrom(middleware, "POST", "/login", "192.0.2.1:1234").Code)
+	assert.Equal(http.StatusOK, serveFrom(middleware, "GET", "/", "192.0.2.1:1234").Code)
+
+	// the login policy is unchanged and keeps its state
+	changed := `
+limits:
+  - name: minute
+    requests_per_minute: 2
+policies:
+  - name: login
+    pattern: POST /login
+    limits:
+      - rate: 1m
+        burst: 1
+        algorithm: sliding-log
+`
+	assert.NoError(os.WriteFile(path, []byte(changed), 0o600))
+	assert.NoError(loader.Reload())
+
+	assert.Equal(http.StatusTooManyRequests, serveFrom(middleware, "POST", "/login", "192.0.2.1:1234").Code)
+	rw := serveFrom(middleware, "GET", "/", "10.1.2.3:1234")
+	assert.Equal(`"minute";q=2;w=60`, rw.Header().Get("RateLimit-Policy"))
+
+	// an invalid file keeps the current policies
+	assert.NoError(os.WriteFile(path, []byte("limits: [{rate: 1s}]\n"), 0o600))
+	assert.ErrorContains(loader.Reload(), "limits[0]: burst must be set along with rate")
+	rw = serveFrom(middleware, "GET", "/", "10.1.2.4:1234")
+	assert.Equal(`"minute";q=2;w=60`, rw.Header().Get("RateLimit-Policy"))
+}
+
+func TestPolicyLoader_ReportsMissingFileOnce(t *testing.T) {
+	assert := a.New(t)
+
+	path := writePolicyFile(t, "policies.yaml", testPolicyFile)
+	loader, err := NewPolicyLoader(path, RateLimiterConfig{Context: context.Background()})
+	assert.NoError(err)
+
+	moved := path + ".old"
+	assert.NoError(os.Rename(path, moved))
+	_, err = loader.reloadIfChanged()
+	assert.Error(err)
+	for range 3 {
+		changed, err := loader.reloadIfChanged()
+		assert.False(changed)
+		assert.NoError(err)
+	}
+
+	// the file is reported again if it goes missing after coming back
+	assert.NoError(os.Rename(moved, path))
+	changed, err := loader.reloadIfChanged()
+	assert.False(changed)
+	assert.NoError(err)
+	assert.NoError(os.Remove(path))
+	_, err = loader.reloadIfChanged()
+	assert.Error(err)
+}
+
+func TestPolicyLoader_Watch(t *testing.T) {
+	assert := a.New(t)
+
+	path := writePolicyFile(t, "policies.yaml", testPolicyFile)
+	loader, err := NewPolicyLoader(path, RateLimiterConfig{Context: context.Background(), Logger: slog.New(slog.DiscardHandler)})
+	assert.NoError(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		loader.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	assert.NoError(os.WriteFile(path, []byte("limits: [{name: hour, rate: 1h, burst: 7}]\n"), 0o600))
+	assert.Eventually(func() bool {
+		rw := serveFrom(loader.Middleware(), "GET", "/", "192.0.2.1:1234")
+		return rw.Header().Get("RateLimit-Policy") == `"hour";q=7;w=25200`
+	}, time.Second, 5*time.Millisecond)
+}
@@ -3,12 +3,17 @@ package ratelimit
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/netip"
+	"net/textproto"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	kit "github.com/stfsy/go-api-kit/server/handlers"
@@ -16,171 +21,400 @@ import (
 
 // RateLimiter represents a simple token bucket rate limiter
 type RateLimiter struct {
-	visitors   map[string]*Visitor
-	mu         sync.RWMutex
-	rate       time.Duration
-	capacity   int
-	ctx        context.Context
-	maxClients int
-	// cleanup configuration
+	store Store
+	// bandwidths are the limits enforced on every key. A request is only
+	// allowed if all of them allow it.
+	bandwidths []Bandwidth
+	// limits holds the Limit of every bandwidth for MultiTaker stores.
+	limits []Limit
+	// prefix is prepended to the store keys, see RoutePolicy.
+	prefix string
+	ctx    context.Context
+	// trustedProxies holds the masked prefixes of trusted reverse proxies.
+	trustedProxies []netip.Prefix
+	logger         *slog.Logger
+	// logSampler deduplicates log events; nil disables sampling.
+	logSampler *logSampler
+	metrics    *Metrics
+	// cleanup configuration; visitorStaleAfter holds a time.Duration and
+	// changes when a PolicyLoader reloads the limits.
 	cleanupInterval   time.Duration
-	visitorStaleAfter time.Duration
-	cleanupBatchSize  int
+	visitorStaleAfter atomic.Int64
 	cleanupOnce       sync.Once
-	cleanupCursor     int
+	// closed is shared with the limiters derived from rl, so closing the
+	// middleware stops all of its policies. stop is closed by Close and
+	// done by the cleanup goroutine when it exits.
+	closed    *atomic.Bool
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	// flush is called by Close, see RateLimiterConfig.FlushOnClose.
+	flush func(ctx context.Context, store Store) error
 }
 
+// ErrClosed is returned by the methods of a RateLimiter that has been
+// closed.
+var ErrClosed = errors.New("rate limiter is closed")
+
 // RateLimiterConfig holds configuration options for the rate limit middleware.
 // New options can be added here (trusted proxies, max visitors, etc.).
 type RateLimiterConfig struct {
+	// RequestsPerMinute is the sustained rate. It is a shorthand for Rate
+	// = time.Minute / RequestsPerMinute and, unless Burst is set, Burst =
+	// RequestsPerMinute. Exactly one of RequestsPerMinute and Rate must be
+	// set.
 	RequestsPerMinute int
-	Context           context.Context
+	// Rate is the time it takes to refill a single token, e.g.
+	// time.Second / 10 for a sustained rate of 10 requests per second.
+	// Burst must be set along with it.
+	Rate time.Duration
+	// Limits enforces several limits on every key at once, e.g. 10 per
+	// second, 300 per minute and 10,000 per day. A request only consumes
+	// tokens if every limit allows it. The RateLimit-Policy header lists
+	// all limits; the RateLimit and Retry-After headers refer to the most
+	// restrictive one. Limits cannot be combined with RequestsPerMinute,
+	// Rate, Burst and Algorithm. See NewCompositeRateLimiter.
+	Limits []Bandwidth
+	// CostFunc returns the number of tokens a request consumes, e.g. more
+	// for expensive routes or large queries. If nil, every request costs
+	// one token. Requests that cost more than the capacity of a limit (or
+	// a negative amount) can never be allowed; they are rejected with
+	// ReasonCost and without a Retry-After header.
+	CostFunc func(r *http.Request) int
+	// Policies apply their own limits to the requests matching their
+	// pattern, e.g. a strict limit for "POST /login". Requests that match
+	// no policy get the limits configured above. The most specific pattern
+	// wins, following the rules of http.ServeMux; patterns that conflict
+	// make RateLimitMiddleware return an error. All policies share one
+	// store, with entries kept separate per policy; see
+	// MaxClientIpsPerMinute for how they count towards its cap.
+	Policies []RoutePolicy
+	Context  context.Context
+	// Algorithm selects how the rate is enforced. The default,
+	// TokenBucket, allows a burst of Burst requests after a quiet
+	// period; SlidingWindow allows at most Burst requests in any window
+	// of Burst * Rate (approximately).
+	Algorithm Algorithm
+	// Burst is the number of requests a client can make at once, i.e. the
+	// capacity of its bucket. Tokens are still refilled at the sustained
+	// rate; for the window algorithms the window becomes Burst * Rate. If
+	// zero, RequestsPerMinute is used.
+	Burst int
 	// TrustedProxyHeader is the name of the header (e.g. "X-Forwarded-For")
 	// that should be trusted when extracting the client IP. If empty,
 	// forwarded headers will be ignored and RemoteAddr will be used.
 	TrustedProxyHeader string
-	// MaxClientIpsPerMinute caps the number of unique client IPs tracked by the
-	// rate limiter. When the number of tracked IPs reaches this value,
-	// new IPs will be rejected until entries expire or are removed.
-	// A value of 0 means no cap.
+	// TrustedProxies lists the networks of the reverse proxies in front of
+	// the application. When set, TrustedProxyHeader is only honoured for
+	// requests whose RemoteAddr lies within one of these prefixes, and the
+	// header is walked from right to left, skipping trusted hops, to find
+	// the client. TrustedProxyHeader defaults to "X-Forwarded-For" when
+	// TrustedProxies is set.
+	TrustedProxies []netip.Prefix
+	// KeyFunc extracts the key requests are limited by. If nil, requests
+	// are keyed by client IP as resolved from TrustedProxyHeader and
+	// TrustedProxies. Requests for which KeyFunc fails or returns an empty
+	// key are rejected with 400 Bad Request. See HeaderKey, ContextKey,
+	// RouteKey and CompositeKey.
+	KeyFunc KeyFunc
+	// Exempt, if set, is called with the key of every request. Requests
+	// for which it returns true bypass the rate limiter: they consume no
+	// tokens, get no RateLimit headers and are not passed to OnDecision.
+	// Use it for health checks or internal clients.
+	Exempt func(r *http.Request, key string) bool
+	// DisableRateLimitHeaders turns off the RateLimit and RateLimit-Policy
+	// response headers that are otherwise sent on every response.
+	DisableRateLimitHeaders bool
+	// LegacyRateLimitHeaders additionally sends X-RateLimit-Limit,
+	// X-RateLimit-Remaining and X-RateLimit-Reset for older clients.
+	LegacyRateLimitHeaders bool
+	// Logger receives structured events for rejected requests and store
+	// failures. If nil, slog.Default() is used.
+	Logger *slog.Logger
+	// LogSampleInterval limits how often the same event (reason and key) is
+	// logged, so a single abusive client cannot flood the logs. The number
+	// of suppressed occurrences is attached to the next line. If zero, one
+	// minute is used; a negative value logs every event.
+	LogSampleInterval time.Duration
+	// Metrics collects decision and cleanup counters, see NewMetrics. A
+	// Metrics value can only be used by a single middleware.
+	Metrics *Metrics
+	// OnDecision, if set, is called for every request with the decision of
+	// the rate limiter. See the ratelimitotel package for an OpenTelemetry
+	// integration.
+	OnDecision DecisionFunc
+	// DenyHandler writes the response for rejected requests. The Retry-After
+	// header (whole seconds, rounded up) is already set when it is called;
+	// res.RetryAfter holds the precise duration. If nil, a 429 Too Many
+	// Requests response is sent.
+	DenyHandler func(rw http.ResponseWriter, r *http.Request, res Result)
+	// Store holds the per-client bucket state. If nil, an in-memory store
+	// configured from MaxClientIpsPerMinute, MaxMemoryBytes and
+	// CleanupBatchSize is used.
+	// Use a shared store to enforce one limit across several replicas.
+	// RateLimitMiddleware returns an error if the store implements
+	// AlgorithmSupporter and does not support the algorithm of a limit.
+	Store Store
+	// MaxClientIpsPerMinute caps the number of unique client IPs (or keys,
+	// see KeyFunc) tracked by the rate limiter. When the number of tracked
+	// IPs reaches this value, new IPs are handled according to
+	// OverflowPolicy.
+	// A value of 0 means no cap. Ignored when Store is set.
+	// A client has a separate entry for every policy it uses, so with
+	// Policies the store holds up to MaxClientIpsPerMinute * (1 +
+	// len(Policies)) entries; the cap is shared, so clients of a busy
+	// policy can take up the room of the others.
 	MaxClientIpsPerMinute int
+	// MaxMemoryBytes caps the approximate memory the in-memory store uses
+	// for its entries, which varies with the length of the keys and the
+	// algorithms, see MemoryStore.MemoryUsage. When it is set and
+	// MaxClientIpsPerMinute is not, the number of clients is not capped.
+	// Ignored when Store is set.
+	MaxMemoryBytes int64
+	// OverflowPolicy decides what happens to new clients once
+	// MaxClientIpsPerMinute or MaxMemoryBytes is reached: rejecting them
+	// (the default) or evicting a tracked client. Ignored when Store is
+	// set.
+	OverflowPolicy OverflowPolicy
 	// CleanupInterval controls how often the background cleanup runs.
 	// If zero, a sensible default (5m) is used.
 	CleanupInterval time.Duration
 	// VisitorStaleDuration controls how long a visitor can be idle before it
-	// is considered stale and eligible for removal. If zero, default is 10m.
+	// is considered stale and eligible for removal. Token bucket and GCRA
+	// visitors count as idle from the time their bucket is full again. If
+	// zero, default is 10m or the time the slowest limit takes to refill,
+	// whichever is longer.
 	VisitorStaleDuration time.Duration
-	// CleanupBatchSize limits the number of visitor entries inspected per cleanup
-	// tick to spread work across ticks. If zero, a sensible default is used.
+	// CleanupBatchSize limits the number of visitor entries the cleanup
+	// inspects while holding the lock of a store shard. Every stale entry
+	// is removed on each tick regardless. If zero, a sensible default is
+	// used. Ignored when Store is set.
 	CleanupBatchSize int
+	// FlushOnClose, if set, is called by Middleware.Close once the cleanup
+	// has stopped, e.g. to persist the state of the store. Its error is
+	// returned by Close.
+	FlushOnClose func(ctx context.Context, store Store) error
 }
 
-// Visitor represents a client's rate limiting state
-type Visitor struct {
-	tokens    int
-	lastToken time.Time
-	mu        sync.Mutex
-}
-
-// NewRateLimiter creates a new rate limiter
+// NewRateLimiter creates a new rate limiter backed by an unbounded
+// MemoryStore. Clients can make requestsPerMinute requests at once and get
+// a new token every minute / requestsPerMinute.
 func NewRateLimiter(ctx context.Context, requestsPerMinute int) (*RateLimiter, error) {
-	// Default and validation: ensure requestsPerMinute is within a sane range to
-	// avoid creating a zero `rate` (which would cause a divide-by-zero panic
-	// in Allow). We default to 30 RPM when a non-positive value is supplied,
-	// and clamp excessively large values to a conservative upper bound.
-	const defaultRPM = 30
-	const maxRPM = 1000000 // 1 million requests per minute is a practical cap
-
-	if requestsPerMinute <= 0 {
-		requestsPerMinute = defaultRPM
-	}
-	if requestsPerMinute > maxRPM {
-		fmt.Printf("requestsPerMinute (%d) too large; clamping to %d\n", requestsPerMinute, maxRPM)
-		requestsPerMinute = maxRPM
+	limit, err := rpmLimit(requestsPerMinute)
+	if err != nil {
+		return nil, err
 	}
+	return newRateLimiter(ctx, []Bandwidth{{Name: defaultPolicyName, Limit: limit}})
+}
 
+func newRateLimiter(ctx context.Context, bandwidths []Bandwidth) (*RateLimiter, error) {
 	if ctx == nil {
 		return nil, fmt.Errorf("context cannot be nil")
 	}
+	if err := validateBandwidths(bandwidths); err != nil {
+		return nil, fmt.Errorf("invalid limit: %w", err)
+	}
 
-	rl := &RateLimiter{}
+	rl := &RateLimiter{closed: new(atomic.Bool), stop: make(chan struct{})}
 	rl.ctx = ctx
-	rl.visitors = make(map[string]*Visitor)
-	rl.rate = time.Minute / time.Duration(requestsPerMinute)
-	// Defensive: ensure rl.rate is never zero. This should not happen because
-	// requestsPerMinute has been clamped, but keep a final guard.
-	if rl.rate <= 0 {
-		rl.rate = time.Nanosecond
-	}
-	rl.capacity = requestsPerMinute
+	rl.store = NewMemoryStore(MemoryStoreConfig{})
+	rl.logger = slog.Default()
+	rl.logSampler = newLogSampler(defaultLogSampleInterval, maxSampledKeys)
+	rl.setBandwidths(bandwidths)
 
 	// initialize cleanup defaults; actual goroutine is started via StartCleanup
 	rl.cleanupInterval = 5 * time.Minute
-	rl.visitorStaleAfter = 10 * time.Minute
-	rl.cleanupBatchSize = 100 // default inspect 100 entries per tick
+	rl.visitorStaleAfter.Store(int64(staleAfter(rl.bandwidths)))
 
 	return rl, nil
 }
 
-// Allow checks if a request from the given IP is allowed
-func (rl *RateLimiter) Allow(ip string) bool {
-	// Defensive: empty IPs must not be used as a map key because that would
-	// collapse many unrelated requests into a single visitor entry. Treat an
-	// empty or all-whitespace ip as not allowed.
-	if strings.TrimSpace(ip) == "" {
-		fmt.Printf("RateLimiter.Allow called with empty client IP; rejecting\n")
-		return false
+// rpmLimit returns the token bucket for requestsPerMinute.
+func rpmLimit(requestsPerMinute int) (Limit, error) {
+	if requestsPerMinute <= 0 {
+		return Limit{}, fmt.Errorf("requests per minute must be positive, got %d", requestsPerMinute)
 	}
-	// Fast path: read-lock to locate visitor without blocking other readers
-	rl.mu.RLock()
-	visitor, exists := rl.visitors[ip]
-	rl.mu.RUnlock()
-
-	if !exists {
-		// Need to create a visitor; upgrade to write lock. Double-check after locking.
-		rl.mu.Lock()
-		visitor, exists = rl.visitors[ip]
-		if !exists {
-			// Enforce maxClients cap if configured
-			if rl.maxClients > 0 && len(rl.visitors) >= rl.maxClients {
-				fmt.Printf("Rate limiter max clients reached (%d); rejecting new IP: %s\n", rl.maxClients, ip)
-				rl.mu.Unlock()
-				// We reject creating a new visitor when the cap is reached
-				return false
-			}
+	rate := time.Minute / time.Duration(requestsPerMinute)
+	if rate <= 0 {
+		// More than one request per nanosecond cannot be represented.
+		return Limit{}, fmt.Errorf("requests per minute %d exceeds one request per nanosecond", requestsPerMinute)
+	}
+	return Limit{Rate: rate, Capacity: requestsPerMinute}, nil
+}
 
-			visitor = &Visitor{
-				tokens:    rl.capacity - 1, // Use one token immediately
-				lastToken: time.Now(),
-			}
-			rl.visitors[ip] = visitor
-			rl.mu.Unlock()
-			return true
+// policies returns the limits described by cfg.
+func (cfg RateLimiterConfig) policies() ([]Bandwidth, error) {
+	if len(cfg.Limits) > 0 {
+		if cfg.RequestsPerMinute != 0 || cfg.Rate != 0 || cfg.Burst != 0 || cfg.Algorithm != TokenBucket {
+			return nil, fmt.Errorf("Limits cannot be combined with RequestsPerMinute, Rate, Burst or Algorithm")
+		}
+		return cfg.Limits, nil
+	}
+	limit, err := cfg.limit()
+	if err != nil {
+		return nil, err
+	}
+	return []Bandwidth{{Name: defaultPolicyName, Limit: limit}}, nil
+}
+
+// proxyHeader returns the header the client IP is read from, defaulting to
+// X-Forwarded-For when trusted proxies are configured.
+func (cfg RateLimiterConfig) proxyHeader() string {
+	if len(cfg.TrustedProxies) > 0 && cfg.TrustedProxyHeader == "" {
+		return "X-Forwarded-For"
+	}
+	return cfg.TrustedProxyHeader
+}
+
+// limit returns the limit described by the rate, burst and algorithm
+// fields of cfg.
+func (cfg RateLimiterConfig) limit() (Limit, error) {
+	var limit Limit
+	switch {
+	case cfg.RequestsPerMinute != 0 && cfg.Rate != 0:
+		return Limit{}, fmt.Errorf("only one of RequestsPerMinute and Rate can be set")
+	case cfg.Rate != 0:
+		if cfg.Rate < 0 {
+			return Limit{}, fmt.Errorf("rate %s must be positive", cfg.Rate)
+		}
+		if cfg.Burst == 0 {
+			return Limit{}, fmt.Errorf("burst must be set along with rate")
 		}
-		rl.mu.Unlock()
+		limit.Rate = cfg.Rate
+	default:
+		var err error
+		if limit, err = rpmLimit(cfg.RequestsPerMinute); err != nil {
+			return Limit{}, err
+		}
+	}
+	if cfg.Burst < 0 {
+		return Limit{}, fmt.Errorf("burst must not be negative, got %d", cfg.Burst)
+	}
+	if cfg.Burst > 0 {
+		limit.Capacity = cfg.Burst
 	}
+	limit.Algorithm = cfg.Algorithm
+	return limit, nil
+}
+
+// Result describes the outcome of a rate limiting decision.
+type Result struct {
+	// Allowed reports whether the request may proceed.
+	Allowed bool
+	// Limit is the capacity of the bucket.
+	Limit int
+	// Remaining is the number of tokens left in the bucket.
+	Remaining int
+	// ResetAfter is the time until the bucket is full again.
+	ResetAfter time.Duration
+	// RetryAfter is the time until the next token becomes available for a
+	// rejected request. It is zero for allowed requests and when the store
+	// could not be consulted.
+	RetryAfter time.Duration
+	// Policy names the limit the other fields refer to: the one that
+	// rejected the request or, if it was allowed, the one with the fewest
+	// remaining tokens. It is sent as the policy name in the RateLimit
+	// headers.
+	Policy string
+}
+
+// Allow checks if a request with the given key (usually the client IP) is
+// allowed
+func (rl *RateLimiter) Allow(key string) bool {
+	return rl.Take(key).Allowed
+}
 
-	visitor.mu.Lock()
-	defer visitor.mu.Unlock()
+// AllowN checks if a request with the given key that costs n tokens is
+// allowed. Requests that cost more than the capacity of a limit are always
+// rejected.
+func (rl *RateLimiter) AllowN(key string, n int) bool {
+	return rl.TakeN(key, n).Allowed
+}
+
+// Take is like Allow but reports the state of the bucket along with the
+// decision.
+func (rl *RateLimiter) Take(key string) Result {
+	return rl.TakeN(key, 1)
+}
 
-	now := time.Now()
-	elapsed := now.Sub(visitor.lastToken)
+// TakeN is like AllowN but reports the state of the bucket along with the
+// decision.
+func (rl *RateLimiter) TakeN(key string, n int) Result {
+	res, reason, err := rl.take(rl.ctx, key, n)
+	// Plain rate rejections are the expected outcome for callers of Take,
+	// so only operational problems are logged here.
+	if reason != "" && reason != ReasonRate {
+		rl.logRejection(rl.ctx, reason, key, res, err)
+	}
+	return res
+}
+
+// take implements TakeN. For rejected requests it also returns the reason
+// and, for ReasonStoreError, the error of the store. ctx bounds the store
+// calls; the middleware passes the context of the request.
+func (rl *RateLimiter) take(ctx context.Context, key string, n int) (Result, string, error) {
+	res, reason, err := rl.takeFromStore(ctx, key, n)
+	if rl.metrics != nil {
+		rl.metrics.observe(reason)
+	}
+	return res, reason, err
+}
 
-	// Use int64 to avoid intermediate overflows for large elapsed durations.
-	tokensToAdd64 := int64(0)
-	if rl.rate > 0 {
-		tokensToAdd64 = int64(elapsed / rl.rate)
+func (rl *RateLimiter) takeFromStore(ctx context.Context, key string, n int) (Result, string, error) {
+	res := rl.emptyResult()
+	if rl.isClosed() {
+		return res, ReasonClosed, ErrClosed
 	}
 
-	if tokensToAdd64 > 0 {
-		// Defensive cap: never add more tokens than the configured capacity in
-		// a single refill step. This prevents extremely large elapsed times
-		// from making huge jumps and advancing lastToken by an unbounded amount.
-		if tokensToAdd64 > int64(rl.capacity) {
-			tokensToAdd64 = int64(rl.capacity)
+	// Defensive: empty keys must not be used as a store key because that would
+	// collapse many unrelated requests into a single visitor entry. Treat an
+	// empty or all-whitespace key as not allowed.
+	if strings.TrimSpace(key) == "" {
+		return res, ReasonNoKey, nil
+	}
+
+	// A request that costs more than a bucket holds would wait forever;
+	// reject it without touching the store.
+	for _, bw := range rl.bandwidths {
+		if n < 0 || n > bw.Capacity {
+			return Result{Limit: bw.Capacity, Policy: bw.Name}, ReasonCost, nil
 		}
+	}
 
-		tokensToAdd := int(tokensToAdd64)
-		visitor.tokens += tokensToAdd
-		if visitor.tokens > rl.capacity {
-			visitor.tokens = rl.capacity
+	var buf [4]TakeResult
+	results, err := rl.takeAll(ctx, key, n, time.Now(), buf[:0])
+	if err != nil {
+		if errors.Is(err, ErrStoreFull) {
+			return res, ReasonMaxClients, nil
 		}
-		// Advance lastToken by the amount of time corresponding to the tokens
-		// we actually added. This preserves the fractional remainder of the
-		// elapsed interval so refill accounting stays accurate.
-		visitor.lastToken = visitor.lastToken.Add(time.Duration(tokensToAdd64) * rl.rate)
+		return res, ReasonStoreError, err
 	}
 
-	if visitor.tokens > 0 {
-		visitor.tokens--
-		return true
+	i := mostRestrictive(results)
+	tr := results[i]
+	res = Result{
+		Allowed:    tr.Allowed,
+		Limit:      rl.bandwidths[i].Capacity,
+		Remaining:  tr.Remaining,
+		ResetAfter: tr.ResetAfter,
+		RetryAfter: tr.RetryAfter,
+		Policy:     rl.bandwidths[i].Name,
+	}
+	if !res.Allowed {
+		return res, ReasonRate, nil
 	}
+	return res, "", nil
+}
 
-	return false
+// emptyResult returns the result reported when no limit could be
+// consulted. It refers to the first limit.
+func (rl *RateLimiter) emptyResult() Result {
+	return Result{Limit: rl.bandwidths[0].Capacity, Policy: rl.bandwidths[0].Name}
 }
 
 // cleanupVisitors removes old visitor entries to prevent memory leaks
 func (rl *RateLimiter) cleanupVisitors() {
+	defer close(rl.done)
 	ticker := time.NewTicker(rl.cleanupInterval)
 	defer ticker.Stop()
 
@@ -188,70 +422,105 @@ func (rl *RateLimiter) cleanupVisitors() {
 		select {
 		case <-rl.ctx.Done():
 			return
+		case <-rl.stop:
+			return
 		case <-ticker.C:
-			cutoff := time.Now().Add(-rl.visitorStaleAfter)
-
-			// Collect keys once to allow batched inspection without holding write lock.
-			rl.mu.RLock()
-			total := len(rl.visitors)
-			if total == 0 {
-				rl.mu.RUnlock()
-				continue
-			}
-			ips := make([]string, 0, total)
-			for ip := range rl.visitors {
-				ips = append(ips, ip)
-			}
-			rl.mu.RUnlock()
-
-			// Walk a batch of entries each tick starting from a cursor to spread work.
-			start := rl.cleanupCursor % len(ips)
-			end := start + rl.cleanupBatchSize
-			if end > len(ips) {
-				end = len(ips)
-			}
-			batch := ips[start:end]
-			rl.cleanupCursor = end % len(ips)
-
-			for _, ip := range batch {
-				rl.mu.RLock()
-				v := rl.visitors[ip]
-				rl.mu.RUnlock()
-				if v == nil {
-					continue
-				}
-				v.mu.Lock()
-				stale := v.lastToken.Before(cutoff)
-				v.mu.Unlock()
-				if stale {
-					rl.mu.Lock()
-					// double-check under write lock then delete
-					if vv, ok := rl.visitors[ip]; ok {
-						vv.mu.Lock()
-						if vv.lastToken.Before(cutoff) {
-							delete(rl.visitors, ip)
-						}
-						vv.mu.Unlock()
-					}
-					rl.mu.Unlock()
-				}
-			}
+			rl.evictStale()
 		}
 	}
 }
 
+// evictStale runs a single cleanup tick.
+func (rl *RateLimiter) evictStale() {
+	start := time.Now()
+	cutoff := start.Add(-time.Duration(rl.visitorStaleAfter.Load()))
+
+	var scanned, evicted int
+	var err error
+	if s, ok := rl.store.(*MemoryStore); ok {
+		scanned, evicted, err = s.evictScan(rl.ctx, cutoff)
+	} else {
+		scanned = -1
+		evicted, err = rl.store.Evict(rl.ctx, cutoff)
+	}
+	if err != nil {
+		rl.logger.Error("rate limiter cleanup failed", slog.Any("error", err))
+	}
+	if rl.metrics != nil {
+		rl.metrics.observeCleanup(scanned, evicted, time.Since(start), err)
+	}
+}
+
 // StartCleanup starts the cleanup goroutine once. It's safe to call multiple
-// times; the background worker will only be started once.
+// times; the background worker will only be started once. It runs until the
+// context of rl is done or rl is closed. Calls after Close do nothing.
 func (rl *RateLimiter) StartCleanup() {
 	rl.cleanupOnce.Do(func() {
+		rl.done = make(chan struct{})
 		go rl.cleanupVisitors()
 	})
 }
 
+// Close stops the cleanup goroutine and waits for it to exit. Afterwards
+// every request is rejected with ReasonClosed; Reserve and Wait return
+// ErrClosed. The store itself is left open. Closing twice does nothing and
+// returns nil.
+func (rl *RateLimiter) Close() error {
+	var err error
+	rl.closeOnce.Do(func() {
+		rl.closed.Store(true)
+		close(rl.stop)
+		// Keep StartCleanup from starting the goroutine after this point.
+		rl.cleanupOnce.Do(func() {})
+		if rl.done != nil {
+			<-rl.done
+		}
+		if rl.flush != nil {
+			// The context of rl is usually done when the server shuts down.
+			err = rl.flush(context.WithoutCancel(rl.ctx), rl.store)
+		}
+	})
+	return err
+}
+
+// isClosed reports whether rl or the limiter it was derived from has been
+// closed.
+func (rl *RateLimiter) isClosed() bool {
+	return rl.closed != nil && rl.closed.Load()
+}
+
 // getClientIP extracts the client IP address from the request.
-// If trustedHeader is non-empty we will attempt to extract and validate
-// the left-most entry from that header (commonly X-Forwarded-For).
+// If trustedHeader is non-empty and no trusted proxies are configured we
+// will attempt to extract and validate the left-most entry from that header
+// (commonly X-Forwarded-For). The RFC 7239 Forwarded header is parsed
+// according to its own grammar and its for= nodes are used as entries.
+// With trusted proxies configured the header is only honoured for requests
+// from a trusted peer, see forwardedClientIP.
 func (rl *RateLimiter) getClientIP(r *http.Request, trustedHeader string) string {
+	return clientIP(r, trustedHeader, rl.trustedProxies)
+}
+
+// clientIP implements getClientIP for the given trusted proxy prefixes.
+func clientIP(r *http.Request, trustedHeader string, trustedProxies []netip.Prefix) string {
+	if trustedHeader != "" && len(trustedProxies) > 0 {
+		return forwardedClientIP(r, trustedHeader, trustedProxies)
+	}
+
+	if trustedHeader != "" && textproto.CanonicalMIMEHeaderKey(trustedHeader) == forwardedHeader {
+		// RFC 7239: pick the left-most for= node that carries an IP.
+		// A header that does not parse is not trusted at all.
+		hops, err := forwardedClientHops(r.Header.Values(forwardedHeader))
+		if err != nil {
+			return ""
+		}
+		for _, ip := range hops {
+			if ip != "" {
+				return ip
+			}
+		}
+		return ""
+	}
+
 	// If a trusted header was provided, try using its first IP
 	if trustedHeader != "" {
 		if hv := r.Header.Get(trustedHeader); hv != "" {
@@ -271,6 +540,80 @@ func (rl *RateLimiter) getClientIP(r *http.Request, trustedHeader string) string
 		return ""
 	}
 
+	return remoteIP(r)
+}
+
+// forwardedClientIP resolves the client IP behind trusted proxies. The
+// forwarded header is only honoured when RemoteAddr is a trusted proxy;
+// otherwise the peer itself is the client. The header is walked from right
+// to left, skipping trusted hops, and the first untrusted address is
+// returned. Entries left of that address were supplied by the client and
+// are never looked at, so prepending a forged value has no effect.
+func forwardedClientIP(r *http.Request, trustedHeader string, trustedProxies []netip.Prefix) string {
+	peer := remoteIP(r)
+	if peer == "" {
+		return ""
+	}
+	if !isTrustedProxy(peer, trustedProxies) {
+		return peer
+	}
+
+	// Every proxy appends to the list, and repeated header lines form a
+	// single list in order of appearance.
+	var hops []string
+	if textproto.CanonicalMIMEHeaderKey(trustedHeader) == forwardedHeader {
+		var err error
+		hops, err = forwardedClientHops(r.Header.Values(forwardedHeader))
+		if err != nil {
+			return ""
+		}
+	} else {
+		for _, hv := range r.Header.Values(trustedHeader) {
+			for _, part := range splitAndTrim(hv, ',') {
+				hops = append(hops, parseIP(stripPort(part)))
+			}
+		}
+	}
+	if len(hops) == 0 {
+		// A trusted proxy did not tell us who its client was. Using the
+		// proxy address would collapse all clients into one bucket.
+		return ""
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := hops[i]
+		if ip == "" {
+			// Entries right of the client are written by our own proxies;
+			// a malformed, unknown or obfuscated one means we cannot
+			// identify the client.
+			return ""
+		}
+		if i == 0 || !isTrustedProxy(ip, trustedProxies) {
+			// The left-most entry is used when every hop is trusted.
+			return ip
+		}
+	}
+	return ""
+}
+
+// isTrustedProxy reports whether ip lies within one of trustedProxies. ip
+// must be a normalized address as returned by parseIP.
+func isTrustedProxy(ip string, trustedProxies []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the normalized IP of r.RemoteAddr or empty.
+func remoteIP(r *http.Request) string {
 	// As a last resort, use RemoteAddr (strip port if present). Validate and
 	// normalize the host portion — return a parsed IP string or empty if the
 	// RemoteAddr does not contain a valid IP. This prevents returning raw
@@ -377,9 +720,38 @@ func parseIP(s string) string {
 	return ""
 }
 
-// RateLimitMiddleware creates a rate limiting middleware
+// RateLimitMiddleware creates a rate limiting middleware. Its cleanup runs
+// until cfg.Context is done; use NewMiddleware for a middleware that can be
+// closed.
 func RateLimitMiddleware(cfg RateLimiterConfig) (func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc), error) {
-	if cfg.MaxClientIpsPerMinute <= 0 {
+	m, err := NewMiddleware(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return m.ServeHTTP, nil
+}
+
+// Middleware is a rate limiting middleware. Its policies can be replaced
+// while it serves requests, see PolicyLoader.
+type Middleware struct {
+	// limiter holds the store, logging, metrics and cleanup shared by all
+	// policies.
+	limiter  *RateLimiter
+	policies atomic.Pointer[policySet]
+}
+
+// policySet is the part of the configuration that is replaced as a whole
+// when policies are reloaded.
+type policySet struct {
+	cfg     RateLimiterConfig
+	routes  *routeTable
+	keyFunc KeyFunc
+}
+
+// NewMiddleware creates the middleware for cfg and starts its cleanup. Call
+// Close when the server shuts down.
+func NewMiddleware(cfg RateLimiterConfig) (*Middleware, error) {
+	if cfg.MaxClientIpsPerMinute <= 0 && cfg.MaxMemoryBytes <= 0 {
 		// Estimated concurrent active users = (N × f) × D where D is average session duration in minutes.
 		// S = 1.2 (some sharing), M = 1.1 (some mobile churn) → f ≈ 1.09
 		// Active users ≈ 10,900 users/minute
@@ -389,42 +761,204 @@ func RateLimitMiddleware(cfg RateLimiterConfig) (func(rw http.ResponseWriter, r
 		cfg.MaxClientIpsPerMinute = 500
 	}
 
-	limiter, err := NewRateLimiter(cfg.Context, cfg.RequestsPerMinute)
+	bandwidths, err := cfg.policies()
+	if err != nil {
+		return nil, fmt.Errorf("invalid limit: %w", err)
+	}
+	limiter, err := newRateLimiter(cfg.Context, bandwidths)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create rate limiter: %w", err)
 	}
-	limiter.maxClients = cfg.MaxClientIpsPerMinute
+	if cfg.Store != nil {
+		limiter.store = cfg.Store
+	} else {
+		limiter.store = NewMemoryStore(MemoryStoreConfig{
+			// Every policy keeps its own entry per client.
+			MaxKeys:          max(cfg.MaxClientIpsPerMinute, 0) * (1 + len(cfg.Policies)),
+			MaxMemoryBytes:   cfg.MaxMemoryBytes,
+			OverflowPolicy:   cfg.OverflowPolicy,
+			CleanupBatchSize: cfg.CleanupBatchSize,
+		})
+	}
+	for _, p := range cfg.TrustedProxies {
+		if !p.IsValid() {
+			return nil, fmt.Errorf("invalid trusted proxy prefix %q", p)
+		}
+		limiter.trustedProxies = append(limiter.trustedProxies, p.Masked())
+	}
+	if cfg.Logger != nil {
+		limiter.logger = cfg.Logger
+	}
+	// The policies derived by apply share the metrics; they are only
+	// attached once the configuration is known to be valid.
+	limiter.metrics = cfg.Metrics
+	switch {
+	case cfg.LogSampleInterval < 0:
+		limiter.logSampler = nil
+	case cfg.LogSampleInterval > 0:
+		limiter.logSampler = newLogSampler(cfg.LogSampleInterval, maxSampledKeys)
+	}
 	// apply optional cleanup overrides
 	if cfg.CleanupInterval > 0 {
 		limiter.cleanupInterval = cfg.CleanupInterval
 	}
-	if cfg.VisitorStaleDuration > 0 {
-		limiter.visitorStaleAfter = cfg.VisitorStaleDuration
+	limiter.flush = cfg.FlushOnClose
+
+	m := &Middleware{limiter: limiter}
+	if err := m.apply(cfg); err != nil {
+		return nil, err
 	}
-	if cfg.CleanupBatchSize > 0 {
-		limiter.cleanupBatchSize = cfg.CleanupBatchSize
+	if cfg.Metrics != nil {
+		if err := cfg.Metrics.attach(limiter.store); err != nil {
+			return nil, err
+		}
 	}
-
 	limiter.StartCleanup()
+	return m, nil
+}
 
-	return func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-		clientIP := limiter.getClientIP(r, cfg.TrustedProxyHeader)
+// apply validates the limits, policies and key settings of cfg and makes
+// them the active policies of m. The store, logging, metrics and cleanup
+// interval stay as they are. Buckets are kept: policies whose limits did
+// not change continue where they left off.
+func (m *Middleware) apply(cfg RateLimiterConfig) error {
+	bandwidths, err := cfg.policies()
+	if err != nil {
+		return fmt.Errorf("invalid limit: %w", err)
+	}
+	if err := validateBandwidths(bandwidths); err != nil {
+		return fmt.Errorf("invalid limit: %w", err)
+	}
+	routes, err := newRouteTable(m.limiter.derive("", bandwidths), cfg.Policies)
+	if err != nil {
+		return err
+	}
+	if err := routes.checkStore(); err != nil {
+		return err
+	}
 
-		// If clientIP is empty then we cannot reliably rate-limit the request.
-		// Reject the request rather than treating it as a shared/empty key.
-		if strings.TrimSpace(clientIP) == "" {
-			fmt.Printf("RateLimitMiddleware: could not determine client IP; rejecting request (RemoteAddr=%q, header=%q)\n", r.RemoteAddr, cfg.TrustedProxyHeader)
-			kit.SendBadRequest(rw, nil)
-			return
+	cfg.TrustedProxyHeader = cfg.proxyHeader()
+	keyFunc := cfg.KeyFunc
+	if keyFunc == nil {
+		keyFunc = IPKey(cfg.TrustedProxyHeader, m.limiter.trustedProxies...)
+	}
+
+	stale := cfg.VisitorStaleDuration
+	if stale <= 0 {
+		// The cleanup of the shared store must keep the entries of the
+		// slowest policy until they have refilled.
+		stale = staleAfter(bandwidths)
+		for _, p := range cfg.Policies {
+			stale = max(stale, staleAfter(p.Limits))
 		}
+	}
+	m.limiter.visitorStaleAfter.Store(int64(stale))
 
-		if !limiter.Allow(clientIP) {
-			fmt.Printf("Rate limit exceeded for IP: %s on path: %s\n", clientIP, r.URL.Path)
-			rw.Header().Set("Retry-After", "60")
-			kit.SendTooManyRequests(rw, nil)
-			return
+	m.policies.Store(&policySet{cfg: cfg, routes: routes, keyFunc: keyFunc})
+	return nil
+}
+
+// Close stops the cleanup of m, waits for it to exit and calls
+// RateLimiterConfig.FlushOnClose. Requests served afterwards are rejected
+// with 503 Service Unavailable and ReasonClosed. Closing twice does nothing
+// and returns nil.
+func (m *Middleware) Close() error {
+	return m.limiter.Close()
+}
+
+// MemoryUsage returns the approximate number of bytes held by the entries
+// of the in-memory store of m, see MemoryStore.MemoryUsage. It returns
+// -1 if RateLimiterConfig.Store is not a *MemoryStore; ask that store
+// instead.
+func (m *Middleware) MemoryUsage() int64 {
+	if s, ok := m.limiter.store.(*MemoryStore); ok {
+		return s.MemoryUsage()
+	}
+	return -1
+}
+
+// ServeHTTP rate limits r with the policies active when it arrives and
+// calls next if it is allowed. Its signature matches the middlewares of
+// negroni.
+func (m *Middleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	p := m.policies.Load()
+	cfg := &p.cfg
+	rt := p.routes.match(r)
+	limiter := rt.limiter
+	var routeAttrs []slog.Attr
+	if len(cfg.Policies) > 0 {
+		routeAttrs = []slog.Attr{slog.String("route", rt.name)}
+	}
+
+	key, err := p.keyFunc(r)
+	if err == nil && strings.TrimSpace(key) == "" {
+		err = errors.New("empty key")
+	}
+
+	// If the key is empty then we cannot reliably rate-limit the request.
+	// Reject the request rather than treating it as a shared/empty key.
+	if err != nil {
+		if limiter.metrics != nil {
+			limiter.metrics.observe(ReasonNoKey)
+		}
+		if cfg.OnDecision != nil {
+			cfg.OnDecision(r, Decision{Result: limiter.emptyResult(), Reason: ReasonNoKey, Route: rt.name})
 		}
+		// Without a key all such requests share one log event.
+		limiter.logRejection(r.Context(), ReasonNoKey, "", limiter.emptyResult(), nil, append(routeAttrs,
+			slog.String("path", r.URL.Path),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.String("header", cfg.TrustedProxyHeader),
+			slog.Any("error", err))...)
+		kit.SendBadRequest(rw, nil)
+		return
+	}
 
+	if cfg.Exempt != nil && cfg.Exempt(r, key) {
 		next(rw, r)
-	}, nil
+		return
+	}
+
+	cost := 1
+	if cfg.CostFunc != nil {
+		cost = cfg.CostFunc(r)
+	}
+
+	res, reason, err := limiter.take(r.Context(), key, cost)
+	if cfg.OnDecision != nil {
+		cfg.OnDecision(r, Decision{Result: res, Key: key, Reason: reason, Cost: cost, Route: rt.name})
+	}
+	if reason == ReasonClosed {
+		// The server is shutting down; there is no limit to report and
+		// retrying here will not help.
+		limiter.logRejection(r.Context(), reason, key, res, err, append(routeAttrs, slog.String("path", r.URL.Path))...)
+		kit.SendServiceUnavailable(rw, nil)
+		return
+	}
+	if !cfg.DisableRateLimitHeaders {
+		setRateLimitHeaders(rw.Header(), res, limiter.bandwidths, cfg.LegacyRateLimitHeaders, time.Now())
+	}
+
+	if !res.Allowed {
+		limiter.logRejection(r.Context(), reason, key, res, err, append(routeAttrs, slog.String("path", r.URL.Path), slog.Int("cost", cost))...)
+		// Waiting does not help a request that costs too much.
+		if reason != ReasonCost {
+			retryAfter := res.RetryAfter
+			if retryAfter <= 0 {
+				// The store was full or failed; a token of a fresh bucket
+				// is the best estimate we have.
+				retryAfter = limiter.bandwidths[0].Rate
+			}
+			// Round up so clients never come back before a token is available.
+			rw.Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(retryAfter), 10))
+		}
+		if cfg.DenyHandler != nil {
+			cfg.DenyHandler(rw, r, res)
+			return
+		}
+		kit.SendTooManyRequests(rw, nil)
+		return
+	}
+
+	next(rw, r)
 }
@@ -0,0 +1,212 @@
+package ratelimit
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var benchAlgorithms = []Algorithm{TokenBucket, GCRA, SlidingWindow, SlidingLog}
+
+func newBenchLimiter(b *testing.B, alg Algorithm) *RateLimiter {
+	rl, err := NewRateLimiter(context.Background(), 6000)
+	if err != nil {
+		b.Fatalf("failed to create rate limiter: %v", err)
+	}
+	rl.bandwidths[0].Algorithm = alg
+	return rl
+}
+
+// BenchmarkAllow measures a single hot key.
+func BenchmarkAllow(b *testing.B) {
+	for _, alg := range benchAlgorithms {
+		b.Run(alg.String(), func(b *testing.B) {
+			rl := newBenchLimiter(b, alg)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rl.Allow("10.0.0.1")
+			}
+		})
+	}
+}
+
+// BenchmarkAllowParallel measures contention on a single hot key.
+func BenchmarkAllowParallel(b *testing.B) {
+	for _, alg := range benchAlgorithms {
+		b.Run(alg.String(), func(b *testing.B) {
+			rl := newBenchLimiter(b, alg)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					rl.Allow("10.0.0.1")
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkTokenBucketHotKeyParallel compares the token bucket packed into
+// a single word with the tokens and time pair it replaced, kept under a
+// mutex, on a single key updated from all CPUs.
+func BenchmarkTokenBucketHotKeyParallel(b *testing.B) {
+	limit := Limit{Rate: time.Microsecond, Capacity: 1000}
+	b.Run("mutex", func(b *testing.B) {
+		var mu sync.Mutex
+		ref := &refBucket{tokens: limit.Capacity, lastToken: time.Now()}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				now := time.Now()
+				mu.Lock()
+				ref.reserve(limit, 1, now, 0)
+				mu.Unlock()
+			}
+		})
+	})
+	b.Run("atomic", func(b *testing.B) {
+		e := newTokenBucketEntry(limit, time.Now())
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				e.take(limit, 1, time.Now())
+			}
+		})
+	})
+}
+
+// BenchmarkAllowManyKeys measures lookups spread over 100k existing keys.
+func BenchmarkAllowManyKeys(b *testing.B) {
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	for _, alg := range benchAlgorithms {
+		b.Run(alg.String(), func(b *testing.B) {
+			rl := newBenchLimiter(b, alg)
+			for _, key := range keys {
+				rl.Allow(key)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				rl.Allow(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+// BenchmarkMemoryStoreNewKeys measures creating entries, including their
+// allocations.
+func BenchmarkMemoryStoreNewKeys(b *testing.B) {
+	for _, alg := range benchAlgorithms {
+		b.Run(alg.String(), func(b *testing.B) {
+			s := NewMemoryStore(MemoryStoreConfig{})
+			limit := Limit{Rate: 10 * time.Millisecond, Capacity: 10, Algorithm: alg}
+			now := time.Now()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _ = s.Take(context.Background(), strconv.Itoa(i), limit, 1, now)
+			}
+		})
+	}
+}
+
+// BenchmarkMemoryStoreNewKeysParallel measures unique keys arriving on all
+// CPUs at once, e.g. a spray of new IPs, with a single shard and with the
+// default number of shards. Compare the shard counts with -cpu 1,4,8.
+func BenchmarkMemoryStoreNewKeysParallel(b *testing.B) {
+	for _, shards := range []int{1, 0} {
+		b.Run("shards="+strconv.Itoa(shardCount(MemoryStoreConfig{Shards: shards})), func(b *testing.B) {
+			s := NewMemoryStore(MemoryStoreConfig{Shards: shards})
+			limit := Limit{Rate: 10 * time.Millisecond, Capacity: 10}
+			now := time.Now()
+			var next atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, _ = s.Take(context.Background(), strconv.FormatInt(next.Add(1), 10), limit, 1, now)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMemoryStoreManyKeysParallel measures lookups spread over 100k
+// existing keys on all CPUs while the cleanup walks the store.
+func BenchmarkMemoryStoreManyKeysParallel(b *testing.B) {
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+	for _, shards := range []int{1, 0} {
+		b.Run("shards="+strconv.Itoa(shardCount(MemoryStoreConfig{Shards: shards})), func(b *testing.B) {
+			s := NewMemoryStore(MemoryStoreConfig{Shards: shards})
+			limit := Limit{Rate: 10 * time.Millisecond, Capacity: 10}
+			now := time.Now()
+			for _, key := range keys {
+				_, _ = s.Take(context.Background(), key, limit, 1, now)
+			}
+			var next atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := next.Add(1)
+					if i%1000 == 0 {
+						_, _ = s.Evict(context.Background(), now.Add(-time.Hour))
+					}
+					_, _ = s.Take(context.Background(), keys[i%int64(len(keys))], limit, 1, now)
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMemoryStoreEvictNoneDue measures a cleanup tick over 100k keys
+// of which none is stale. It does not depend on the number of keys.
+func BenchmarkMemoryStoreEvictNoneDue(b *testing.B) {
+	s := NewMemoryStore(MemoryStoreConfig{})
+	limit := Limit{Rate: 10 * time.Millisecond, Capacity: 10}
+	now := time.Now()
+	for i := 0; i < 100000; i++ {
+		_, _ = s.Take(context.Background(), strconv.Itoa(i), limit, 1, now)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = s.Evict(context.Background(), now)
+	}
+}
+
+// BenchmarkMemoryStoreBytesPerKey reports the heap held per key, including
+// the key itself and the map and bookkeeping overhead of the store.
+func BenchmarkMemoryStoreBytesPerKey(b *testing.B) {
+	const keys = 100000
+	for _, alg := range []Algorithm{TokenBucket, GCRA} {
+		b.Run(alg.String(), func(b *testing.B) {
+			limit := Limit{Rate: 10 * time.Millisecond, Capacity: 10, Algorithm: alg}
+			now := time.Now()
+			var perKey float64
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				s := NewMemoryStore(MemoryStoreConfig{MaxKeys: keys})
+				for k := 0; k < keys; k++ {
+					_, _ = s.Take(context.Background(), strconv.Itoa(k), limit, 1, now)
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				perKey = float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / keys
+				runtime.KeepAlive(s)
+			}
+			b.ReportMetric(perKey, "B/key")
+		})
+	}
+}
@@ -18,6 +18,8 @@ func FuzzGetClientIP(f *testing.F) {
 		{"X-Real-IP", "10.0.0.5", "127.0.0.1:8080"},
 		{"", "", "192.0.2.1:5555"},
 		{"X-Forwarded-For", "[2001:db8::1]:443, 198.51.100.7", "[2001:db8::1]:443"},
+		{"Forwarded", `for="[2001:db8:cafe::17]:4711";proto=https, for=192.0.2.43`, "10.0.0.1:1234"},
+		{"Forwarded", "for=_hidden;by=unknown, for=198.51.100.17", "10.0.0.1:1234"},
 	}
 
 	for _, s := range seeds {
@@ -35,7 +37,7 @@ func FuzzGetClientIP(f *testing.F) {
 			t.Fatalf("failed to create rate limiter: %v", err)
 		}
 		// keep cap moderate for fuzzing
-		rl.maxClients = 200
+		rl.store = NewMemoryStore(MemoryStoreConfig{MaxKeys: 200})
 
 		out := rl.getClientIP(req, headerName)
 		fmt.Printf("FuzzGetClientIP output: %q\n", out)
@@ -56,6 +58,41 @@ func FuzzGetClientIP(f *testing.F) {
 	})
 }
 
+// FuzzParseForwarded fuzzes the RFC 7239 Forwarded header parser. It ensures
+// the parser never panics and that every for= node it resolves is a
+// normalized IP address.
+func FuzzParseForwarded(f *testing.F) {
+	seeds := []string{
+		"for=192.0.2.60;proto=http;by=203.0.113.43",
+		`For="[2001:db8:cafe::17]:4711"`,
+		"for=192.0.2.43, for=198.51.100.17;by=_hidden",
+		`for=unknown;ext="a,b\"c", for=_SEVKISEK:_port`,
+		` , for=192.0.2.43;;proto=https ,,`,
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		elems, err := parseForwarded([]string{value})
+		if err != nil {
+			return
+		}
+		for _, e := range elems {
+			ip := parseForwardedNode(e.For)
+			if ip == "" {
+				continue
+			}
+			if ip != parseIP(ip) {
+				t.Fatalf("node %q resolved to non-normalized IP %q", e.For, ip)
+			}
+			if strings.ContainsAny(ip, ", \n\r\t[]") {
+				t.Fatalf("node %q resolved to %q", e.For, ip)
+			}
+		}
+	})
+}
+
 // FuzzAllow ensures calling Allow with arbitrary IP strings does not panic
 // and returns a boolean. The limiter is small to limit memory growth during fuzzing.
 func FuzzAllow(f *testing.F) {
@@ -70,7 +107,7 @@ func FuzzAllow(f *testing.F) {
 			t.Fatalf("failed to create rate limiter: %v", err)
 		}
 		// keep cap moderate so the fuzz harness doesn't blow memory
-		rl.maxClients = 50
+		rl.store = NewMemoryStore(MemoryStoreConfig{MaxKeys: 50})
 
 		// call Allow with the fuzzed IP; just ensure no panic and a bool is returned
 		_ = rl.Allow(ip)
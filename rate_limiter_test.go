@@ -2,8 +2,11 @@ package ratelimit
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"testing"
 	"time"
 
@@ -29,15 +32,38 @@ func TestRateLimiter_Allow(t *testing.T) {
 	assert.True(limiter.Allow("192.168.1.1"))
 }
 
+func TestRateLimiter_Take(t *testing.T) {
+	assert := a.New(t)
+
+	limiter, err := NewRateLimiter(context.Background(), 2) // 2 requests per minute
+	assert.NoError(err)
+
+	res := limiter.Take("127.0.0.1")
+	assert.True(res.Allowed)
+	assert.Equal(2, res.Limit)
+	assert.Equal(1, res.Remaining)
+	assert.InDelta(30*time.Second, res.ResetAfter, float64(time.Second))
+
+	limiter.Take("127.0.0.1")
+	res = limiter.Take("127.0.0.1")
+	assert.False(res.Allowed)
+	assert.Equal(0, res.Remaining)
+	assert.InDelta(60*time.Second, res.ResetAfter, float64(time.Second))
+
+	res = limiter.Take("")
+	assert.False(res.Allowed)
+	assert.Equal(2, res.Limit)
+}
+
 func TestRateLimiter_TokenRefresh(t *testing.T) {
 	assert := a.New(t)
 
 	// Create a rate limiter with very fast refresh for testing
 	limiter := &RateLimiter{
-		visitors: make(map[string]*Visitor),
-		rate:     100 * time.Millisecond, // Very fast for testing
-		capacity: 1,
-		ctx:      context.Background(),
+		store: NewMemoryStore(MemoryStoreConfig{}),
+		// Very fast for testing
+		bandwidths: []Bandwidth{{Name: "default", Limit: Limit{Rate: 100 * time.Millisecond, Capacity: 1}}},
+		ctx:        context.Background(),
 	}
 
 	// Use up the token
@@ -121,6 +147,37 @@ func TestRateLimitMiddleware_Block(t *testing.T) {
 	assert.Equal("60", rw2.Header().Get("Retry-After"))
 }
 
+func TestRateLimitMiddleware_RetryAfterFromRefillTime(t *testing.T) {
+	assert := a.New(t)
+
+	var denied Result
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 600,
+		Context:           context.Background(),
+		DenyHandler: func(rw http.ResponseWriter, r *http.Request, res Result) {
+			denied = res
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		},
+	})
+	assert.NoError(err)
+
+	var rw *httptest.ResponseRecorder
+	for i := 0; i < 601; i++ {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rw = httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+	}
+
+	// at 600 RPM the next token is at most 100ms away; the header is
+	// rounded up to whole seconds while the handler sees the exact value
+	assert.Equal(http.StatusServiceUnavailable, rw.Code)
+	assert.Equal("1", rw.Header().Get("Retry-After"))
+	assert.False(denied.Allowed)
+	assert.Greater(denied.RetryAfter, time.Duration(0))
+	assert.LessOrEqual(denied.RetryAfter, 100*time.Millisecond)
+}
+
 func TestGetClientIP(t *testing.T) {
 	assert := a.New(t)
 	limiter, err := NewRateLimiter(context.Background(), 10)
@@ -227,6 +284,79 @@ func TestGetClientIP_HeaderBracketedIPv6WithPort(t *testing.T) {
 	assert.Equal("2001:db8::1", ip)
 }
 
+func TestGetClientIP_TrustedProxies(t *testing.T) {
+	limiter, err := NewRateLimiter(context.Background(), 10)
+	a.NoError(t, err)
+	limiter.trustedProxies = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8:ffff::/48"),
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    []string
+		want       string
+	}{
+		{"untrusted peer ignores header", "203.0.113.9:1234", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"single proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"forged prefix is skipped", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"two proxy layers", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"repeated header lines", "10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"ipv6 proxy", "[2001:db8:ffff::1]:443", []string{"[2001:db8::1]:4711"}, "2001:db8::1"},
+		{"ipv4 mapped peer", "[::ffff:10.0.0.1]:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"all hops trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"malformed hop", "10.0.0.1:1234", []string{"198.51.100.1, garbage, 10.0.0.2"}, ""},
+		{"missing header", "10.0.0.1:1234", nil, ""},
+		{"malformed remote addr", "garbage", []string{"198.51.100.1"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, h := range tt.headers {
+				req.Header.Add("X-Forwarded-For", h)
+			}
+			a.Equal(t, tt.want, limiter.getClientIP(req, "X-Forwarded-For"))
+		})
+	}
+}
+
+func TestRateLimitMiddleware_TrustedProxies(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		TrustedProxies:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	assert.NoError(err)
+
+	serve := func(remoteAddr, xff string) int {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", xff)
+		rw := httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		return rw.Code
+	}
+
+	assert.Equal(200, serve("10.0.0.1:1234", "198.51.100.1"))
+	// a forged left-most entry does not buy the client a fresh bucket
+	assert.Equal(429, serve("10.0.0.1:1234", "1.2.3.4, 198.51.100.1"))
+	// X-Forwarded-For is the default header
+	assert.Equal(200, serve("10.0.0.1:1234", "198.51.100.2"))
+}
+
+func TestRateLimitMiddleware_InvalidTrustedProxy(t *testing.T) {
+	_, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		TrustedProxies:    []netip.Prefix{{}},
+	})
+	a.Error(t, err)
+}
+
 func TestControlCharHeaderMiddleware(t *testing.T) {
 	assert := a.New(t)
 
@@ -292,7 +422,7 @@ func TestMaxClientIpsCap(t *testing.T) {
 
 	rl, err := NewRateLimiter(context.Background(), 10)
 	assert.NoError(err)
-	rl.maxClients = 2
+	rl.store = NewMemoryStore(MemoryStoreConfig{MaxKeys: 2})
 
 	// Allowed: first two distinct IPs
 	assert.True(rl.Allow("10.0.0.1"))
@@ -305,6 +435,52 @@ func TestMaxClientIpsCap(t *testing.T) {
 	assert.True(rl.Allow("10.0.0.1")) // existing visitor should still be present and allowed
 }
 
+func TestRateLimitMiddleware_MaxMemoryBytes(t *testing.T) {
+	assert := a.New(t)
+
+	m, err := NewMiddleware(RateLimiterConfig{RequestsPerMinute: 10, Context: context.Background(), MaxMemoryBytes: 1 << 20})
+	assert.NoError(err)
+	defer m.Close()
+	store := m.limiter.store.(*MemoryStore)
+	assert.Equal(0, store.maxKeys, "a memory budget replaces the default client cap")
+	assert.Equal(int64(1<<20), store.maxBytes)
+
+	for i := range 501 {
+		rw := serveFrom(m.ServeHTTP, "GET", "/", fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256))
+		assert.Equal(http.StatusOK, rw.Code)
+	}
+	assert.Positive(store.MemoryUsage())
+	assert.LessOrEqual(store.MemoryUsage(), int64(1<<20))
+	assert.Equal(store.MemoryUsage(), m.MemoryUsage())
+
+	shared, err := NewMiddleware(RateLimiterConfig{RequestsPerMinute: 10, Context: context.Background(), Store: &ctxStore{Store: NewMemoryStore(MemoryStoreConfig{})}})
+	assert.NoError(err)
+	defer shared.Close()
+	assert.Equal(int64(-1), shared.MemoryUsage(), "only a MemoryStore is reported")
+}
+
+func TestRateLimitMiddleware_OverflowEvictLRU(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute:     10,
+		Context:               context.Background(),
+		MaxClientIpsPerMinute: 2,
+		OverflowPolicy:        OverflowEvictLRU,
+	})
+	assert.NoError(err)
+
+	// a client arriving after the cap was reached displaces the least
+	// recently seen one instead of being locked out
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = ip + ":1234"
+		rw := httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		assert.Equal(http.StatusOK, rw.Code, ip)
+	}
+}
+
 func TestAllowEmptyIPRejected(t *testing.T) {
 	assert := a.New(t)
 
@@ -337,19 +513,66 @@ func TestMiddlewareRejectsEmptyClientIP(t *testing.T) {
 	assert.Equal(400, rw.Code)
 }
 
-func TestNewRateLimiter_ClampsLargeRPM(t *testing.T) {
+func TestNewRateLimiter_RejectsInvalidRPM(t *testing.T) {
 	assert := a.New(t)
 
-	// extremely large value should be clamped and should not cause division by zero
+	for _, rpm := range []int{0, -1, 1 << 62} {
+		_, err := NewRateLimiter(context.Background(), rpm)
+		assert.Error(err, "rpm %d", rpm)
+	}
+
+	// a large but representable rate is kept as is
 	rl, err := NewRateLimiter(context.Background(), 1_000_000_000)
 	assert.NoError(err)
-	// rate should be > 0
-	assert.True(rl.rate > 0)
-
-	// And Allow should not panic when called (use a normal IP)
+	assert.Equal(60*time.Nanosecond, rl.bandwidths[0].Rate)
+	assert.Equal(1_000_000_000, rl.bandwidths[0].Capacity)
 	assert.NotPanics(func() { _ = rl.Allow("127.0.0.1") })
 }
 
+func TestRateLimitMiddleware_RateAndBurst(t *testing.T) {
+	assert := a.New(t)
+
+	// 10 requests per second, but at most 2 at once
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		Rate:    100 * time.Millisecond,
+		Burst:   2,
+		Context: context.Background(),
+	})
+	assert.NoError(err)
+
+	codes := make([]int, 0, 3)
+	var rw *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rw = httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		codes = append(codes, rw.Code)
+	}
+
+	assert.Equal([]int{200, 200, 429}, codes)
+	assert.Equal(`"default";q=2;w=1`, rw.Header().Get("RateLimit-Policy"))
+	assert.Equal("1", rw.Header().Get("Retry-After"))
+}
+
+func TestRateLimitMiddleware_InvalidRate(t *testing.T) {
+	assert := a.New(t)
+
+	for name, cfg := range map[string]RateLimiterConfig{
+		"no rate":            {},
+		"negative rpm":       {RequestsPerMinute: -1},
+		"rpm and rate":       {RequestsPerMinute: 10, Rate: time.Second, Burst: 1},
+		"negative rate":      {Rate: -time.Second, Burst: 1},
+		"rate without burst": {Rate: time.Second},
+		"negative burst":     {RequestsPerMinute: 10, Burst: -1},
+		"refill overflow":    {Rate: 24 * time.Hour, Burst: 200000},
+	} {
+		cfg.Context = context.Background()
+		_, err := RateLimitMiddleware(cfg)
+		assert.Error(err, name)
+	}
+}
+
 func TestParseIP_BracketedIPv6(t *testing.T) {
 	assert := a.New(t)
 
@@ -373,11 +596,8 @@ func TestParseIP_BracketedIPv6(t *testing.T) {
 	assert.NoError(err)
 	assert.True(rl.Allow(ip))
 
-	rl.mu.RLock()
-	_, exists := rl.visitors[ip]
-	rl.mu.RUnlock()
-
-	assert.True(exists, "visitor map should contain normalized unbracketed IP key")
+	store := rl.store.(*MemoryStore)
+	assert.NotNil(store.load(ip), "visitor map should contain normalized unbracketed IP key")
 }
 
 func TestCleanupEvictsStaleVisitor(t *testing.T) {
@@ -386,26 +606,23 @@ func TestCleanupEvictsStaleVisitor(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	rl, err := NewRateLimiter(ctx, 10)
+	// the bucket is full again 10ms after a request
+	rl, err := NewRateLimiter(ctx, 6000)
 	assert.NoError(err)
 
 	// configure aggressive cleanup for test
 	rl.cleanupInterval = 20 * time.Millisecond
-	rl.visitorStaleAfter = 30 * time.Millisecond
-	rl.cleanupBatchSize = 100
+	rl.visitorStaleAfter.Store(int64(30 * time.Millisecond))
 	rl.StartCleanup()
 
 	ip := "10.10.10.10"
 	assert.True(rl.Allow(ip))
 
 	// wait long enough for the visitor to become stale and for cleanup to run
-	time.Sleep(rl.visitorStaleAfter + rl.cleanupInterval + 20*time.Millisecond)
+	time.Sleep(10*time.Millisecond + 30*time.Millisecond + rl.cleanupInterval + 20*time.Millisecond)
 
-	rl.mu.RLock()
-	_, exists := rl.visitors[ip]
-	rl.mu.RUnlock()
-
-	assert.False(exists, "stale visitor should have been evicted by cleanup")
+	store := rl.store.(*MemoryStore)
+	assert.Nil(store.load(ip), "stale visitor should have been evicted by cleanup")
 }
 
 func TestCleanupKeepsActiveVisitor(t *testing.T) {
@@ -419,27 +636,198 @@ func TestCleanupKeepsActiveVisitor(t *testing.T) {
 
 	// configure aggressive cleanup for test
 	rl.cleanupInterval = 20 * time.Millisecond
-	rl.visitorStaleAfter = 200 * time.Millisecond
-	rl.cleanupBatchSize = 100
+	rl.visitorStaleAfter.Store(int64(200 * time.Millisecond))
 	rl.StartCleanup()
 
 	ip := "10.10.10.11"
 	assert.True(rl.Allow(ip))
 
-	// touch the visitor to set lastToken to now
-	rl.mu.RLock()
-	v := rl.visitors[ip]
-	rl.mu.RUnlock()
-	v.mu.Lock()
-	v.lastToken = time.Now()
-	v.mu.Unlock()
+	// use the visitor again
+	assert.True(rl.Allow(ip))
+	store := rl.store.(*MemoryStore)
 
 	// wait a single cleanup tick (less than stale threshold)
 	time.Sleep(rl.cleanupInterval + 10*time.Millisecond)
 
-	rl.mu.RLock()
-	_, exists := rl.visitors[ip]
-	rl.mu.RUnlock()
+	assert.NotNil(store.load(ip), "recently active visitor should not be evicted")
+}
+
+func TestRateLimiter_AllowN(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewRateLimiter(context.Background(), 10)
+	assert.NoError(err)
+
+	assert.True(rl.AllowN("k", 4))
+	res := rl.TakeN("k", 5)
+	assert.True(res.Allowed)
+	assert.Equal(1, res.Remaining)
+	assert.False(rl.AllowN("k", 2))
+	// free requests are allowed on an empty bucket
+	assert.True(rl.AllowN("k", 1))
+	assert.True(rl.AllowN("k", 0))
+
+	// a cost above the capacity never fits and does not touch the store
+	res, reason, err := rl.take(context.Background(), "other", 11)
+	assert.NoError(err)
+	assert.Equal(ReasonCost, reason)
+	assert.False(res.Allowed)
+	assert.Equal(10, res.Limit)
+	assert.Nil(rl.store.(*MemoryStore).load("other"))
+
+	_, reason, _ = rl.take(context.Background(), "other", -1)
+	assert.Equal(ReasonCost, reason)
+}
+
+func TestRateLimitMiddleware_CostFunc(t *testing.T) {
+	assert := a.New(t)
+
+	var decisions []Decision
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 60,
+		Context:           context.Background(),
+		CostFunc: func(r *http.Request) int {
+			if r.URL.Path == "/export" {
+				return 50
+			}
+			if r.URL.Path == "/everything" {
+				return 100
+			}
+			return 1
+		},
+		OnDecision: func(r *http.Request, d Decision) { decisions = append(decisions, d) },
+	})
+	assert.NoError(err)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rw := httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		return rw
+	}
+
+	assert.Equal(http.StatusOK, serve("/export").Code)
+	assert.Equal(`"default";r=9;t=51`, serve("/health").Header().Get("RateLimit"))
+
+	rw := serve("/export")
+	assert.Equal(http.StatusTooManyRequests, rw.Code)
+	assert.Equal("41", rw.Header().Get("Retry-After"))
+
+	// more than the bucket holds: rejected without a hint to come back
+	rw = serve("/everything")
+	assert.Equal(http.StatusTooManyRequests, rw.Code)
+	assert.Empty(rw.Header().Get("Retry-After"))
+	if assert.Len(decisions, 4) {
+		assert.Equal(50, decisions[0].Cost)
+		assert.Equal(ReasonCost, decisions[3].Reason)
+		assert.Equal(100, decisions[3].Cost)
+	}
+}
+
+// ctxStore records the contexts its calls receive.
+type ctxStore struct {
+	Store
+	ctxs []context.Context
+}
+
+func (s *ctxStore) Take(ctx context.Context, key string, limit Limit, n int, now time.Time) (TakeResult, error) {
+	s.ctxs = append(s.ctxs, ctx)
+	if err := ctx.Err(); err != nil {
+		return TakeResult{}, err
+	}
+	return s.Store.Take(ctx, key, limit, n, now)
+}
+
+func TestRateLimitMiddleware_PassesRequestContextToStore(t *testing.T) {
+	assert := a.New(t)
+
+	store := &ctxStore{Store: NewMemoryStore(MemoryStoreConfig{})}
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{RequestsPerMinute: 10, Context: context.Background(), Store: store})
+	assert.NoError(err)
 
-	assert.True(exists, "recently active visitor should not be evicted")
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "request"))
+	cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rw := httptest.NewRecorder()
+	called := false
+	middleware(rw, req, func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	assert.False(called, "a cancelled request must not reach the handler")
+	assert.Equal(http.StatusTooManyRequests, rw.Code)
+	if assert.Len(store.ctxs, 1) {
+		assert.Equal("request", store.ctxs[0].Value(ctxKey{}))
+	}
+}
+
+func TestRateLimiter_Close(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewRateLimiter(context.Background(), 10)
+	assert.NoError(err)
+	rl.cleanupInterval = time.Millisecond
+	rl.StartCleanup()
+	assert.True(rl.Allow("10.0.0.1"))
+
+	assert.NoError(rl.Close())
+	select {
+	case <-rl.done:
+	default:
+		t.Fatal("cleanup goroutine still running after Close")
+	}
+
+	for range 3 {
+		assert.False(rl.Allow("10.0.0.1"))
+		assert.False(rl.Allow("10.0.0.2"))
+	}
+	_, reason, err := rl.take(context.Background(), "10.0.0.1", 1)
+	assert.Equal(ReasonClosed, reason)
+	assert.ErrorIs(err, ErrClosed)
+	_, err = rl.Reserve(context.Background(), "10.0.0.1")
+	assert.ErrorIs(err, ErrClosed)
+	assert.ErrorIs(rl.Wait(context.Background(), "10.0.0.1"), ErrClosed)
+	assert.NoError(rl.Close())
+}
+
+func TestRateLimiter_CloseBeforeStartCleanup(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewRateLimiter(context.Background(), 10)
+	assert.NoError(err)
+	assert.NoError(rl.Close())
+	rl.StartCleanup()
+	assert.Nil(rl.done, "StartCleanup must not start a goroutine after Close")
+}
+
+func TestMiddleware_Close(t *testing.T) {
+	assert := a.New(t)
+
+	var flushed []Store
+	var reasons []string
+	m, err := NewMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 10,
+		Context:           context.Background(),
+		Policies:          []RoutePolicy{{Name: "login", Pattern: "POST /login", Limits: []Bandwidth{{Name: "login", Limit: Limit{Rate: time.Minute, Capacity: 1}}}}},
+		OnDecision:        func(r *http.Request, d Decision) { reasons = append(reasons, d.Reason) },
+		FlushOnClose: func(ctx context.Context, store Store) error {
+			assert.NoError(ctx.Err())
+			flushed = append(flushed, store)
+			return errors.New("disk full")
+		},
+	})
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, serveFrom(m.ServeHTTP, "GET", "/", "10.0.0.1:1234").Code)
+
+	assert.EqualError(m.Close(), "disk full")
+	assert.Equal([]Store{m.limiter.store}, flushed)
+	assert.NoError(m.Close())
+	assert.Len(flushed, 1, "Close flushes only once")
+
+	for _, req := range []struct{ method, path string }{{"GET", "/"}, {"POST", "/login"}} {
+		rw := serveFrom(m.ServeHTTP, req.method, req.path, "10.0.0.2:1234")
+		assert.Equal(http.StatusServiceUnavailable, rw.Code, req.path)
+		assert.Empty(rw.Header().Get("Retry-After"), req.path)
+	}
+	assert.Equal([]string{"", ReasonClosed, ReasonClosed}, reasons)
 }
@@ -0,0 +1,111 @@
+// Package ratelimitotel records the decisions of
+// ratelimit.RateLimitMiddleware with OpenTelemetry. It annotates the span of
+// the incoming request, usually started by otelhttp, and counts decisions
+// with an OpenTelemetry meter.
+//
+//	hook, err := ratelimitotel.OnDecision(ratelimitotel.Config{})
+//	if err != nil {
+//		return err
+//	}
+//	mw, err := ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{
+//		RequestsPerMinute: 100,
+//		Context:           ctx,
+//		OnDecision:        hook,
+//	})
+package ratelimitotel
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+
+	ratelimit "github.com/stfsy/go-rate-limit"
+)
+
+const instrumentationName = "github.com/stfsy/go-rate-limit/ratelimitotel"
+
+// Attribute keys recorded on spans and metrics.
+const (
+	KeyAttribute       = attribute.Key("ratelimit.key")
+	DecisionAttribute  = attribute.Key("ratelimit.decision")
+	ReasonAttribute    = attribute.Key("ratelimit.reason")
+	PolicyAttribute    = attribute.Key("ratelimit.policy")
+	RouteAttribute     = attribute.Key("ratelimit.route")
+	LimitAttribute     = attribute.Key("ratelimit.limit")
+	RemainingAttribute = attribute.Key("ratelimit.remaining")
+)
+
+// Config holds configuration options for OnDecision.
+type Config struct {
+	// MeterProvider creates the decision counter. If nil, the global
+	// provider is used.
+	MeterProvider metric.MeterProvider
+	// OmitKey leaves the rate limit key out of span attributes. Set it when
+	// keys are sensitive, e.g. API tokens. Keys are never recorded on
+	// metrics because of their cardinality.
+	OmitKey bool
+}
+
+// OnDecision returns a hook for ratelimit.RateLimiterConfig.OnDecision.
+//
+// The hook sets the ratelimit.* attributes on the span found in the request
+// context and adds a "ratelimit.rejected" event to it when the request was
+// rejected. Requests without a recording span are only counted. The
+// "ratelimit.decisions" counter is incremented for every request with the
+// decision, reason, policy and route attributes.
+func OnDecision(cfg Config) (ratelimit.DecisionFunc, error) {
+	mp := cfg.MeterProvider
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	decisions, err := mp.Meter(instrumentationName).Int64Counter("ratelimit.decisions",
+		metric.WithDescription("Requests seen by the rate limiter by decision."),
+		metric.WithUnit("{request}"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create decision counter: %w", err)
+	}
+
+	return func(r *http.Request, d ratelimit.Decision) {
+		decision := "allowed"
+		if !d.Allowed {
+			decision = "rejected"
+		}
+		common := []attribute.KeyValue{
+			DecisionAttribute.String(decision),
+			PolicyAttribute.String(d.Policy),
+		}
+		if d.Reason != "" {
+			common = append(common, ReasonAttribute.String(d.Reason))
+		}
+		if d.Route != "" {
+			common = append(common, RouteAttribute.String(d.Route))
+		}
+		decisions.Add(r.Context(), 1, metric.WithAttributes(common...))
+
+		span := trace.SpanFromContext(r.Context())
+		if !span.IsRecording() {
+			return
+		}
+		attrs := make([]attribute.KeyValue, 0, len(common)+3)
+		attrs = append(attrs, common...)
+		attrs = append(attrs,
+			LimitAttribute.Int(d.Limit),
+			RemainingAttribute.Int(d.Remaining),
+		)
+		if !cfg.OmitKey && d.Key != "" {
+			attrs = append(attrs, KeyAttribute.String(d.Key))
+		}
+		span.SetAttributes(attrs...)
+		if !d.Allowed {
+			span.AddEvent("ratelimit.rejected", trace.WithAttributes(
+				ReasonAttribute.String(d.Reason),
+				attribute.Float64("ratelimit.retry_after", d.RetryAfter.Seconds()),
+			))
+		}
+	}, nil
+}
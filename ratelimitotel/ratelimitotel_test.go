@@ -0,0 +1,144 @@
+package ratelimitotel_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	ratelimit "github.com/stfsy/go-rate-limit"
+	"github.com/stfsy/go-rate-limit/ratelimitotel"
+)
+
+// setup returns a middleware at 1 RPM instrumented with in-memory exporters.
+func setup(t *testing.T, cfg ratelimitotel.Config) (func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc), *sdktrace.TracerProvider, *tracetest.SpanRecorder, *sdkmetric.ManualReader) {
+	reader := sdkmetric.NewManualReader()
+	cfg.MeterProvider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	hook, err := ratelimitotel.OnDecision(cfg)
+	if err != nil {
+		t.Fatalf("failed to create hook: %v", err)
+	}
+
+	mw, err := ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{
+		RequestsPerMinute: 1,
+		Context:           context.Background(),
+		OnDecision:        hook,
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return mw, tp, recorder, reader
+}
+
+func serve(mw func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc), tp *sdktrace.TracerProvider) {
+	ctx, span := tp.Tracer("test").Start(context.Background(), "GET /test")
+	defer span.End()
+	req := httptest.NewRequest("GET", "/test", nil).WithContext(ctx)
+	req.RemoteAddr = "192.0.2.1:1234"
+	mw(httptest.NewRecorder(), req, func(w http.ResponseWriter, r *http.Request) {})
+}
+
+func TestOnDecision_AnnotatesSpans(t *testing.T) {
+	assert := a.New(t)
+	mw, tp, recorder, _ := setup(t, ratelimitotel.Config{})
+
+	serve(mw, tp)
+	serve(mw, tp)
+
+	spans := recorder.Ended()
+	if !assert.Len(spans, 2) {
+		return
+	}
+
+	allowed := attribute.NewSet(spans[0].Attributes()...)
+	v, _ := allowed.Value(ratelimitotel.DecisionAttribute)
+	assert.Equal("allowed", v.AsString())
+	v, _ = allowed.Value(ratelimitotel.KeyAttribute)
+	assert.Equal("192.0.2.1", v.AsString())
+	v, _ = allowed.Value(ratelimitotel.PolicyAttribute)
+	assert.Equal("default", v.AsString())
+	v, _ = allowed.Value(ratelimitotel.RouteAttribute)
+	assert.Equal("default", v.AsString())
+	v, _ = allowed.Value(ratelimitotel.LimitAttribute)
+	assert.Equal(int64(1), v.AsInt64())
+	v, _ = allowed.Value(ratelimitotel.RemainingAttribute)
+	assert.Equal(int64(0), v.AsInt64())
+	assert.False(allowed.HasValue(ratelimitotel.ReasonAttribute))
+	assert.Empty(spans[0].Events())
+
+	rejected := attribute.NewSet(spans[1].Attributes()...)
+	v, _ = rejected.Value(ratelimitotel.DecisionAttribute)
+	assert.Equal("rejected", v.AsString())
+	v, _ = rejected.Value(ratelimitotel.ReasonAttribute)
+	assert.Equal(ratelimit.ReasonRate, v.AsString())
+	if assert.Len(spans[1].Events(), 1) {
+		event := spans[1].Events()[0]
+		assert.Equal("ratelimit.rejected", event.Name)
+		attrs := attribute.NewSet(event.Attributes...)
+		retry, _ := attrs.Value("ratelimit.retry_after")
+		assert.Greater(retry.AsFloat64(), 0.0)
+	}
+}
+
+func TestOnDecision_OmitKey(t *testing.T) {
+	assert := a.New(t)
+	mw, tp, recorder, _ := setup(t, ratelimitotel.Config{OmitKey: true})
+
+	serve(mw, tp)
+
+	if spans := recorder.Ended(); assert.Len(spans, 1) {
+		attrs := attribute.NewSet(spans[0].Attributes()...)
+		assert.False(attrs.HasValue(ratelimitotel.KeyAttribute))
+	}
+}
+
+func TestOnDecision_CountsDecisions(t *testing.T) {
+	assert := a.New(t)
+	mw, tp, _, reader := setup(t, ratelimitotel.Config{})
+
+	for i := 0; i < 3; i++ {
+		serve(mw, tp)
+	}
+
+	var rm metricdata.ResourceMetrics
+	assert.NoError(reader.Collect(context.Background(), &rm))
+	if !assert.Len(rm.ScopeMetrics, 1) || !assert.Len(rm.ScopeMetrics[0].Metrics, 1) {
+		return
+	}
+	m := rm.ScopeMetrics[0].Metrics[0]
+	assert.Equal("ratelimit.decisions", m.Name)
+
+	sum, ok := m.Data.(metricdata.Sum[int64])
+	if !assert.True(ok) {
+		return
+	}
+	counts := map[string]int64{}
+	for _, dp := range sum.DataPoints {
+		decision, _ := dp.Attributes.Value(ratelimitotel.DecisionAttribute)
+		reason, _ := dp.Attributes.Value(ratelimitotel.ReasonAttribute)
+		assert.False(dp.Attributes.HasValue(ratelimitotel.KeyAttribute))
+		counts[decision.AsString()+"/"+reason.AsString()] = dp.Value
+	}
+	assert.Equal(map[string]int64{"allowed/": 1, "rejected/rate": 2}, counts)
+}
+
+func TestOnDecision_WithoutSpan(t *testing.T) {
+	assert := a.New(t)
+	hook, err := ratelimitotel.OnDecision(ratelimitotel.Config{})
+	assert.NoError(err)
+
+	// the global no-op providers must not panic
+	assert.NotPanics(func() {
+		hook(httptest.NewRequest("GET", "/test", nil), ratelimit.Decision{Result: ratelimit.Result{Policy: "default"}, Reason: ratelimit.ReasonNoKey})
+	})
+}
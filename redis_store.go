@@ -0,0 +1,594 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// takeScript refills and takes from a bucket stored as a hash with the
+// fields "tokens" and "last" and returns {allowed, tokens, reset, retry},
+// where reset is the time until the bucket is full again and retry the
+// time until n tokens are available. Times are passed in
+// microseconds so they stay exact within Lua's double precision numbers.
+// The key expires once the bucket would be full again, because a full
+// bucket is indistinguishable from a missing one.
+//
+// KEYS[1] = bucket key
+// ARGV    = rate (µs), capacity, n, now (µs)
+const takeScript = `-- ratelimit:take
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local now = tonumber(ARGV[4])
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil or last == nil then
+	if n > capacity then
+		return {0, capacity, 0, 0}
+	end
+	tokens = capacity
+	last = now
+else
+	local add = math.floor((now - last) / rate)
+	if add > 0 then
+		tokens = math.min(capacity, tokens + add)
+		last = last + add * rate
+	end
+end
+
+local allowed = 0
+local retry = 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+elseif n <= capacity then
+	retry = last + (n - tokens) * rate - now
+end
+
+local reset = math.max(last + (capacity - tokens) * rate - now, 0)
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'last', last)
+redis.call('PEXPIRE', KEYS[1], math.max(math.ceil(reset / 1000), 1))
+return {allowed, tokens, reset, retry}
+`
+
+// refillScript puts tokens back into an existing bucket.
+//
+// KEYS[1] = bucket key
+// ARGV    = capacity, n
+const refillScript = `-- ratelimit:refill
+local capacity = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+
+local tokens = tonumber(redis.call('HGET', KEYS[1], 'tokens'))
+if tokens == nil then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'tokens', math.min(capacity, tokens + n))
+return 1
+`
+
+// takeAllScript refills the buckets of several limits stored in one hash,
+// with the fields "tokens:i" and "last:i" for limit i, and takes n tokens
+// from each of them if every one holds at least n. It returns {allowed}
+// followed by {allowed, tokens, reset, retry} per limit, where tokens and
+// reset describe the bucket as if the tokens had been taken. A new key is
+// not created if it cannot be taken from at all.
+//
+// KEYS[1] = bucket key
+// ARGV    = n, now (µs), then rate (µs) and capacity of every limit
+const takeAllScript = `-- ratelimit:take-all
+local n = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local count = (#ARGV - 2) / 2
+
+local fields = {}
+for i = 1, count do
+	fields[2 * i - 1] = 'tokens:' .. i
+	fields[2 * i] = 'last:' .. i
+end
+local state = redis.call('HMGET', KEYS[1], unpack(fields))
+
+local rate, capacity, tokens, last = {}, {}, {}, {}
+local allowed = 1
+local exists = false
+for i = 1, count do
+	rate[i] = tonumber(ARGV[2 * i + 1])
+	capacity[i] = tonumber(ARGV[2 * i + 2])
+	tokens[i] = tonumber(state[2 * i - 1])
+	last[i] = tonumber(state[2 * i])
+	if tokens[i] == nil or last[i] == nil then
+		tokens[i] = capacity[i]
+		last[i] = now
+	else
+		exists = true
+		local add = math.floor((now - last[i]) / rate[i])
+		if add > 0 then
+			tokens[i] = math.min(capacity[i], tokens[i] + add)
+			last[i] = last[i] + add * rate[i]
+		end
+	end
+	if tokens[i] < n then
+		allowed = 0
+	end
+end
+
+local reply = {allowed}
+local ttl = 0
+for i = 1, count do
+	local ok = 0
+	local left = tokens[i]
+	local retry = 0
+	if tokens[i] >= n then
+		ok = 1
+		left = tokens[i] - n
+		if allowed == 1 then
+			tokens[i] = left
+		end
+	elseif n <= capacity[i] then
+		retry = last[i] + (n - tokens[i]) * rate[i] - now
+	end
+	local reset = math.max(last[i] + (capacity[i] - left) * rate[i] - now, 0)
+	ttl = math.max(ttl, last[i] + (capacity[i] - tokens[i]) * rate[i] - now)
+	reply[4 * i - 2] = ok
+	reply[4 * i - 1] = left
+	reply[4 * i] = reset
+	reply[4 * i + 1] = retry
+end
+
+if allowed == 1 or exists then
+	local values = {}
+	for i = 1, count do
+		values[4 * i - 3] = 'tokens:' .. i
+		values[4 * i - 2] = tokens[i]
+		values[4 * i - 1] = 'last:' .. i
+		values[4 * i] = last[i]
+	end
+	redis.call('HSET', KEYS[1], unpack(values))
+	redis.call('PEXPIRE', KEYS[1], math.max(math.ceil(ttl / 1000), 1))
+end
+return reply
+`
+
+// refillAllScript puts tokens back into the buckets of an existing hash
+// written by takeAllScript.
+//
+// KEYS[1] = bucket key
+// ARGV    = n, then the capacity of every limit
+const refillAllScript = `-- ratelimit:refill-all
+local n = tonumber(ARGV[1])
+
+local refilled = 0
+for i = 1, #ARGV - 1 do
+	local field = 'tokens:' .. i
+	local tokens = tonumber(redis.call('HGET', KEYS[1], field))
+	if tokens ~= nil then
+		redis.call('HSET', KEYS[1], field, math.min(tonumber(ARGV[i + 1]), tokens + n))
+		refilled = 1
+	end
+end
+return refilled
+`
+
+var (
+	takeScriptSHA      = scriptSHA(takeScript)
+	refillScriptSHA    = scriptSHA(refillScript)
+	takeAllScriptSHA   = scriptSHA(takeAllScript)
+	refillAllScriptSHA = scriptSHA(refillAllScript)
+)
+
+func scriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// RedisStoreConfig holds configuration options for a RedisStore.
+type RedisStoreConfig struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+	// Username and Password are sent with AUTH when Password is non-empty.
+	Username string
+	Password string
+	// DB selects the logical database. Zero keeps the server default.
+	DB int
+	// KeyPrefix is prepended to every bucket key. If empty, "ratelimit:" is used.
+	KeyPrefix string
+	// PoolSize caps the number of open connections. If zero, 10 is used.
+	PoolSize int
+	// DialTimeout bounds connection setup. If zero, 5s is used.
+	DialTimeout time.Duration
+	// ReadTimeout and WriteTimeout bound reading a reply and sending a
+	// command. The deadline of the request context applies as well,
+	// whichever comes first. If zero, 1s is used.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Dial opens connections to Addr. If nil, a net.Dialer is used. Set it
+	// to use TLS or a custom network.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// RedisStore is a Store that keeps buckets in Redis so that several
+// processes enforce a single limit. Refill and take run atomically on the
+// server in a Lua script; TakeAll checks all limits of a composite rate
+// limiter in a single script and keeps them in one hash per key. Keys expire on their own once a bucket is full
+// again, so Evict is a no-op.
+//
+// Bucket math uses the clock of the calling process. Keep replica clocks in
+// sync (e.g. with NTP); skew between replicas shifts refill times by the
+// same amount.
+//
+// Every command is bounded by ReadTimeout, WriteTimeout and the request
+// context. When Redis is down or does not answer in time, Take returns an
+// error and RateLimitMiddleware rejects the request with 429 Too Many
+// Requests and ReasonStoreError: the limiter fails closed. Wrap the store
+// to fail open instead.
+type RedisStore struct {
+	cfg RedisStoreConfig
+	// sem limits the number of open connections, idle holds connections
+	// that are ready for reuse.
+	sem    chan struct{}
+	idle   chan *respConn
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewRedisStore creates a store talking to the Redis server at cfg.Addr.
+// Connections are opened lazily on first use.
+func NewRedisStore(cfg RedisStoreConfig) (*RedisStore, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("redis address cannot be empty")
+	}
+	if cfg.KeyPrefix == "" {
+		cfg.KeyPrefix = "ratelimit:"
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 10
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 5 * time.Second
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = time.Second
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = time.Second
+	}
+	if cfg.Dial == nil {
+		d := &net.Dialer{}
+		cfg.Dial = d.DialContext
+	}
+
+	return &RedisStore{
+		cfg:  cfg,
+		sem:  make(chan struct{}, cfg.PoolSize),
+		idle: make(chan *respConn, cfg.PoolSize),
+	}, nil
+}
+
+// Supports implements AlgorithmSupporter. Only TokenBucket is supported.
+func (s *RedisStore) Supports(alg Algorithm) bool {
+	return alg == TokenBucket
+}
+
+// Take implements Store.
+func (s *RedisStore) Take(ctx context.Context, key string, limit Limit, n int, now time.Time) (TakeResult, error) {
+	rate, err := s.rate(limit)
+	if err != nil {
+		return TakeResult{}, err
+	}
+
+	reply, err := s.eval(ctx, takeScript, takeScriptSHA, s.cfg.KeyPrefix+key,
+		strconv.FormatInt(rate, 10),
+		strconv.Itoa(limit.Capacity),
+		strconv.Itoa(n),
+		strconv.FormatInt(now.UnixMicro(), 10),
+	)
+	if err != nil {
+		return TakeResult{}, fmt.Errorf("failed to take from bucket: %w", err)
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 4 {
+		return TakeResult{}, fmt.Errorf("unexpected take reply %v", reply)
+	}
+	res, ok := takeResult(values)
+	if !ok {
+		return TakeResult{}, fmt.Errorf("unexpected take reply %v", reply)
+	}
+	return res, nil
+}
+
+// TakeAll implements MultiTaker. A single limit is taken with Take.
+func (s *RedisStore) TakeAll(ctx context.Context, key string, limits []Limit, n int, now time.Time) ([]TakeResult, error) {
+	if len(limits) == 1 {
+		res, err := s.Take(ctx, key, limits[0], n, now)
+		if err != nil {
+			return nil, err
+		}
+		return []TakeResult{res}, nil
+	}
+
+	args := make([]string, 0, 2+2*len(limits))
+	args = append(args, strconv.Itoa(n), strconv.FormatInt(now.UnixMicro(), 10))
+	for _, limit := range limits {
+		rate, err := s.rate(limit)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strconv.FormatInt(rate, 10), strconv.Itoa(limit.Capacity))
+	}
+
+	reply, err := s.eval(ctx, takeAllScript, takeAllScriptSHA, s.cfg.KeyPrefix+key, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take from buckets: %w", err)
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 1+4*len(limits) {
+		return nil, fmt.Errorf("unexpected take reply %v", reply)
+	}
+	results := make([]TakeResult, len(limits))
+	for i := range results {
+		if results[i], ok = takeResult(values[1+4*i : 5+4*i]); !ok {
+			return nil, fmt.Errorf("unexpected take reply %v", reply)
+		}
+	}
+	return results, nil
+}
+
+// rate returns the rate of limit in microseconds, the resolution of the
+// scripts.
+func (s *RedisStore) rate(limit Limit) (int64, error) {
+	if !s.Supports(limit.Algorithm) {
+		return 0, fmt.Errorf("algorithm %s is not supported by the redis store", limit.Algorithm)
+	}
+	rate := limit.Rate.Microseconds()
+	if rate <= 0 {
+		return 0, fmt.Errorf("rate %s is below the redis store resolution of 1µs", limit.Rate)
+	}
+	return rate, nil
+}
+
+// takeResult parses the {allowed, tokens, reset, retry} reply of a bucket.
+func takeResult(values []any) (TakeResult, bool) {
+	allowed, ok1 := values[0].(int64)
+	remaining, ok2 := values[1].(int64)
+	reset, ok3 := values[2].(int64)
+	retry, ok4 := values[3].(int64)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return TakeResult{}, false
+	}
+	return TakeResult{
+		Allowed:    allowed == 1,
+		Remaining:  int(remaining),
+		ResetAfter: time.Duration(reset) * time.Microsecond,
+		RetryAfter: time.Duration(retry) * time.Microsecond,
+	}, true
+}
+
+// Refill implements Store.
+func (s *RedisStore) Refill(ctx context.Context, key string, limit Limit, n int) error {
+	_, err := s.eval(ctx, refillScript, refillScriptSHA, s.cfg.KeyPrefix+key,
+		strconv.Itoa(limit.Capacity),
+		strconv.Itoa(n),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to refill bucket: %w", err)
+	}
+	return nil
+}
+
+// RefillAll implements MultiTaker.
+func (s *RedisStore) RefillAll(ctx context.Context, key string, limits []Limit, n int) error {
+	if len(limits) == 1 {
+		return s.Refill(ctx, key, limits[0], n)
+	}
+	args := make([]string, 0, 1+len(limits))
+	args = append(args, strconv.Itoa(n))
+	for _, limit := range limits {
+		args = append(args, strconv.Itoa(limit.Capacity))
+	}
+	if _, err := s.eval(ctx, refillAllScript, refillAllScriptSHA, s.cfg.KeyPrefix+key, args...); err != nil {
+		return fmt.Errorf("failed to refill buckets: %w", err)
+	}
+	return nil
+}
+
+// Evict implements Store. Redis expires buckets on its own, so Evict never
+// removes anything.
+func (s *RedisStore) Evict(_ context.Context, _ time.Time) (int, error) {
+	return 0, nil
+}
+
+// Len implements Store. It walks all keys matching KeyPrefix with SCAN, so
+// it is meant for diagnostics rather than the request path.
+func (s *RedisStore) Len(ctx context.Context) (int, error) {
+	match := escapeRedisPattern(s.cfg.KeyPrefix) + "*"
+	cursor := "0"
+	total := 0
+	for {
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", match, "COUNT", "1000")
+		if err != nil {
+			return 0, fmt.Errorf("failed to scan keys: %w", err)
+		}
+		values, ok := reply.([]any)
+		if !ok || len(values) != 2 {
+			return 0, fmt.Errorf("unexpected scan reply %v", reply)
+		}
+		next, ok1 := values[0].(string)
+		keys, ok2 := values[1].([]any)
+		if !ok1 || !ok2 {
+			return 0, fmt.Errorf("unexpected scan reply %v", reply)
+		}
+		total += len(keys)
+		if next == "0" {
+			return total, nil
+		}
+		cursor = next
+	}
+}
+
+// Close closes all idle connections. Connections in use are closed when
+// they are returned.
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	var errs []error
+	for {
+		select {
+		case c := <-s.idle:
+			errs = append(errs, c.close())
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// eval runs a script via EVALSHA and falls back to EVAL when the server
+// does not know the script yet. EVAL also caches the script, so the
+// fallback happens at most once per server restart.
+func (s *RedisStore) eval(ctx context.Context, script, sha, key string, args ...string) (any, error) {
+	cmd := append([]string{"EVALSHA", sha, "1", key}, args...)
+	reply, err := s.do(ctx, cmd...)
+	if err != nil {
+		return nil, err
+	}
+	if rerr, ok := reply.(respError); ok && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		cmd[0], cmd[1] = "EVAL", script
+		reply, err = s.do(ctx, cmd...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rerr, ok := reply.(respError); ok {
+		return nil, rerr
+	}
+	return reply, nil
+}
+
+// do runs a single command on a pooled connection. Error replies are
+// returned as respError values; the returned error is only set for
+// connection failures.
+func (s *RedisStore) do(ctx context.Context, args ...string) (any, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(ctx, args...)
+	if err != nil {
+		s.discard(c)
+		return nil, err
+	}
+	s.put(c)
+	return reply, nil
+}
+
+// get returns an idle connection or dials a new one while the pool has
+// capacity left.
+func (s *RedisStore) get(ctx context.Context) (*respConn, error) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil, errors.New("redis store is closed")
+	}
+
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+
+	select {
+	case c := <-s.idle:
+		return c, nil
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	c, err := s.dial(ctx)
+	if err != nil {
+		<-s.sem
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *RedisStore) put(c *respConn) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		s.discard(c)
+		return
+	}
+	// idle has room for every connection the semaphore admits
+	s.idle <- c
+}
+
+func (s *RedisStore) discard(c *respConn) {
+	_ = c.close()
+	<-s.sem
+}
+
+// dial opens a connection and runs the AUTH/SELECT handshake.
+func (s *RedisStore) dial(ctx context.Context) (*respConn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, s.cfg.DialTimeout)
+	defer cancel()
+
+	conn, err := s.cfg.Dial(dialCtx, "tcp", s.cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	c := newRESPConn(conn, s.cfg.ReadTimeout, s.cfg.WriteTimeout)
+
+	var handshake [][]string
+	if s.cfg.Password != "" {
+		if s.cfg.Username != "" {
+			handshake = append(handshake, []string{"AUTH", s.cfg.Username, s.cfg.Password})
+		} else {
+			handshake = append(handshake, []string{"AUTH", s.cfg.Password})
+		}
+	}
+	if s.cfg.DB != 0 {
+		handshake = append(handshake, []string{"SELECT", strconv.Itoa(s.cfg.DB)})
+	}
+	for _, cmd := range handshake {
+		reply, err := c.do(dialCtx, cmd...)
+		if err == nil {
+			if rerr, ok := reply.(respError); ok {
+				err = rerr
+			}
+		}
+		if err != nil {
+			_ = c.close()
+			return nil, fmt.Errorf("failed to run %s: %w", cmd[0], err)
+		}
+	}
+	return c, nil
+}
+
+// escapeRedisPattern escapes glob metacharacters for use in SCAN MATCH.
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
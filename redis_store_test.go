@@ -0,0 +1,591 @@
+package ratelimit_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+
+	ratelimit "github.com/stfsy/go-rate-limit"
+	"github.com/stfsy/go-rate-limit/storetest"
+)
+
+// fakeRedis is an in-process RESP server that understands the commands
+// used by RedisStore. Scripts are not interpreted; the server recognizes
+// them by their first line and runs an equivalent Go implementation. The
+// Lua code of the store is therefore not executed by these tests; set
+// REDIS_ADDR to run the conformance suite against a real server, see
+// TestRedisStore_ConformanceWithRedis.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	scripts  map[string]string
+	buckets  map[string]*fakeBucket
+	commands []string
+	failEval bool
+}
+
+type fakeBucket struct {
+	tokens, last float64
+	// parts holds the buckets of the limits stored by take-all.
+	parts    []fakePart
+	ttl      time.Duration
+	expireAt time.Time
+}
+
+type fakePart struct {
+	tokens, last float64
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	f := &fakeRedis{
+		ln:      ln,
+		scripts: make(map[string]string),
+		buckets: make(map[string]*fakeBucket),
+	}
+	go f.serve()
+	t.Cleanup(func() { _ = ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, f.exec(args)); err != nil {
+			return
+		}
+	}
+}
+
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("invalid command header %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cmd := strings.ToUpper(args[0])
+	f.commands = append(f.commands, strings.Join(append([]string{cmd}, args[1:]...), " "))
+	switch cmd {
+	case "AUTH":
+		if args[len(args)-1] != f.password {
+			return "-WRONGPASS invalid username-password pair\r\n"
+		}
+		return "+OK\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "EVAL":
+		if f.failEval {
+			return "-ERR something went wrong\r\n"
+		}
+		f.scripts[fakeSHA(args[1])] = args[1]
+		return f.run(args[1], args[3], args[4:])
+	case "EVALSHA":
+		script, ok := f.scripts[args[1]]
+		if !ok {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		return f.run(script, args[3], args[4:])
+	case "SCAN":
+		prefix := strings.TrimSuffix(strings.ReplaceAll(args[3], `\`, ""), "*")
+		var b strings.Builder
+		n := 0
+		for key := range f.buckets {
+			if strings.HasPrefix(key, prefix) && f.bucket(key) != nil {
+				fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(key), key)
+				n++
+			}
+		}
+		return fmt.Sprintf("*2\r\n$1\r\n0\r\n*%d\r\n%s", n, b.String())
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+// bucket returns the bucket stored under key unless it expired.
+func (f *fakeRedis) bucket(key string) *fakeBucket {
+	b := f.buckets[key]
+	if b != nil && time.Now().After(b.expireAt) {
+		delete(f.buckets, key)
+		return nil
+	}
+	return b
+}
+
+func (f *fakeRedis) run(script, key string, argv []string) string {
+	num := func(i int) float64 {
+		v, _ := strconv.ParseFloat(argv[i], 64)
+		return v
+	}
+	switch {
+	case strings.HasPrefix(script, "-- ratelimit:take-all"):
+		return f.takeAll(key, len(argv), num)
+	case strings.HasPrefix(script, "-- ratelimit:take"):
+		rate, capacity, n, now := num(0), num(1), num(2), num(3)
+		b := f.bucket(key)
+		if b == nil {
+			if n > capacity {
+				return fmt.Sprintf("*4\r\n:0\r\n:%d\r\n:0\r\n:0\r\n", int64(capacity))
+			}
+			b = &fakeBucket{tokens: capacity, last: now}
+			f.buckets[key] = b
+		} else if add := math.Floor((now - b.last) / rate); add > 0 {
+			b.tokens = math.Min(capacity, b.tokens+add)
+			b.last += add * rate
+		}
+		allowed, retry := 0, 0.0
+		if b.tokens >= n {
+			b.tokens -= n
+			allowed = 1
+		} else if n <= capacity {
+			retry = b.last + (n-b.tokens)*rate - now
+		}
+		reset := math.Max(b.last+(capacity-b.tokens)*rate-now, 0)
+		b.ttl = time.Duration(math.Max(math.Ceil(reset/1000), 1)) * time.Millisecond
+		b.expireAt = time.Now().Add(b.ttl)
+		return fmt.Sprintf("*4\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n", allowed, int64(b.tokens), int64(reset), int64(retry))
+	case strings.HasPrefix(script, "-- ratelimit:refill-all"):
+		n := num(0)
+		b := f.bucket(key)
+		if b == nil {
+			return ":0\r\n"
+		}
+		for i := 0; i < len(b.parts) && i+1 < len(argv); i++ {
+			b.parts[i].tokens = math.Min(num(i+1), b.parts[i].tokens+n)
+		}
+		return ":1\r\n"
+	case strings.HasPrefix(script, "-- ratelimit:refill"):
+		capacity, n := num(0), num(1)
+		b := f.bucket(key)
+		if b == nil {
+			return ":0\r\n"
+		}
+		b.tokens = math.Min(capacity, b.tokens+n)
+		return ":1\r\n"
+	default:
+		return "-ERR unknown script\r\n"
+	}
+}
+
+// takeAll emulates takeAllScript.
+func (f *fakeRedis) takeAll(key string, argc int, num func(int) float64) string {
+	n, now := num(0), num(1)
+	count := (argc - 2) / 2
+	b := f.bucket(key)
+	exists := b != nil
+	if !exists {
+		b = &fakeBucket{}
+	}
+	if len(b.parts) < count {
+		b.parts = append(b.parts, make([]fakePart, count-len(b.parts))...)
+	}
+	allowed := 1
+	for i := 0; i < count; i++ {
+		rate, capacity := num(2+2*i), num(3+2*i)
+		p := &b.parts[i]
+		if !exists {
+			p.tokens, p.last = capacity, now
+		} else if add := math.Floor((now - p.last) / rate); add > 0 {
+			p.tokens = math.Min(capacity, p.tokens+add)
+			p.last += add * rate
+		}
+		if p.tokens < n {
+			allowed = 0
+		}
+	}
+
+	reply := fmt.Sprintf("*%d\r\n:%d\r\n", 1+4*count, allowed)
+	ttl := 0.0
+	for i := 0; i < count; i++ {
+		rate, capacity := num(2+2*i), num(3+2*i)
+		p := &b.parts[i]
+		ok, left, retry := 0, p.tokens, 0.0
+		if p.tokens >= n {
+			ok, left = 1, p.tokens-n
+			if allowed == 1 {
+				p.tokens = left
+			}
+		} else if n <= capacity {
+			retry = p.last + (n-p.tokens)*rate - now
+		}
+		reset := math.Max(p.last+(capacity-left)*rate-now, 0)
+		ttl = math.Max(ttl, p.last+(capacity-p.tokens)*rate-now)
+		reply += fmt.Sprintf(":%d\r\n:%d\r\n:%d\r\n:%d\r\n", ok, int64(left), int64(reset), int64(retry))
+	}
+	if allowed == 1 || exists {
+		b.ttl = time.Duration(math.Max(math.Ceil(ttl/1000), 1)) * time.Millisecond
+		b.expireAt = time.Now().Add(b.ttl)
+		f.buckets[key] = b
+	}
+	return reply
+}
+
+func (f *fakeRedis) commandNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]string, 0, len(f.commands))
+	for _, c := range f.commands {
+		out = append(out, strings.SplitN(c, " ", 2)[0])
+	}
+	return out
+}
+
+func fakeSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestRedisStore(t *testing.T, f *fakeRedis, cfg ratelimit.RedisStoreConfig) *ratelimit.RedisStore {
+	cfg.Addr = f.addr()
+	s, err := ratelimit.NewRedisStore(cfg)
+	if err != nil {
+		t.Fatalf("failed to create redis store: %v", err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestRedisStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) ratelimit.Store {
+		return newTestRedisStore(t, newFakeRedis(t), ratelimit.RedisStoreConfig{})
+	})
+}
+
+// TestRedisStore_ConformanceWithRedis runs the conformance suite against
+// the Redis server at REDIS_ADDR, e.g. REDIS_ADDR=localhost:6379 go test.
+// Every subtest uses its own key prefix, so the database is not flushed.
+func TestRedisStore_ConformanceWithRedis(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+	storetest.Run(t, func(t *testing.T) ratelimit.Store {
+		s, err := ratelimit.NewRedisStore(ratelimit.RedisStoreConfig{
+			Addr:      addr,
+			Password:  os.Getenv("REDIS_PASSWORD"),
+			KeyPrefix: "ratelimit-test:" + strconv.FormatInt(time.Now().UnixNano(), 36) + ":",
+		})
+		if err != nil {
+			t.Fatalf("failed to create redis store: %v", err)
+		}
+		t.Cleanup(func() { _ = s.Close() })
+		return s
+	})
+}
+
+func TestRedisStore_FallsBackToEvalOnNoScript(t *testing.T) {
+	assert := a.New(t)
+
+	f := newFakeRedis(t)
+	s := newTestRedisStore(t, f, ratelimit.RedisStoreConfig{})
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 2}
+
+	for i := 0; i < 2; i++ {
+		res, err := s.Take(context.Background(), "k", limit, 1, time.Now())
+		assert.NoError(err)
+		assert.True(res.Allowed)
+	}
+
+	assert.Equal([]string{"EVALSHA", "EVAL", "EVALSHA"}, f.commandNames())
+}
+
+func TestRedisStore_AuthAndSelect(t *testing.T) {
+	assert := a.New(t)
+
+	f := newFakeRedis(t)
+	f.password = "secret"
+	s := newTestRedisStore(t, f, ratelimit.RedisStoreConfig{Username: "app", Password: "secret", DB: 2})
+
+	_, err := s.Take(context.Background(), "k", ratelimit.Limit{Rate: time.Second, Capacity: 2}, 1, time.Now())
+	assert.NoError(err)
+	assert.Equal([]string{"AUTH app secret", "SELECT 2"}, f.commands[:2])
+}
+
+func TestRedisStore_WrongPassword(t *testing.T) {
+	assert := a.New(t)
+
+	f := newFakeRedis(t)
+	f.password = "secret"
+	s := newTestRedisStore(t, f, ratelimit.RedisStoreConfig{Password: "wrong"})
+
+	_, err := s.Take(context.Background(), "k", ratelimit.Limit{Rate: time.Second, Capacity: 2}, 1, time.Now())
+	assert.ErrorContains(err, "WRONGPASS")
+}
+
+func TestRedisStore_ErrorReply(t *testing.T) {
+	assert := a.New(t)
+
+	f := newFakeRedis(t)
+	f.failEval = true
+	s := newTestRedisStore(t, f, ratelimit.RedisStoreConfig{})
+
+	_, err := s.Take(context.Background(), "k", ratelimit.Limit{Rate: time.Second, Capacity: 2}, 1, time.Now())
+	assert.ErrorContains(err, "something went wrong")
+}
+
+func TestRedisStore_KeyPrefixAndTTL(t *testing.T) {
+	assert := a.New(t)
+
+	f := newFakeRedis(t)
+	s := newTestRedisStore(t, f, ratelimit.RedisStoreConfig{KeyPrefix: "rl:"})
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 3}
+
+	_, err := s.Take(context.Background(), "10.0.0.1", limit, 3, time.Now())
+	assert.NoError(err)
+
+	f.mu.Lock()
+	b := f.buckets["rl:10.0.0.1"]
+	f.mu.Unlock()
+	if assert.NotNil(b) {
+		// an empty bucket is full again after capacity * rate
+		assert.Equal(3*time.Second, b.ttl)
+	}
+
+	n, err := s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(1, n)
+}
+
+func TestRedisStore_TakeAllUsesOneScript(t *testing.T) {
+	assert := a.New(t)
+
+	f := newFakeRedis(t)
+	s := newTestRedisStore(t, f, ratelimit.RedisStoreConfig{KeyPrefix: "rl:"})
+	mw, err := ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{
+		Context: context.Background(),
+		Store:   s,
+		Limits: []ratelimit.Bandwidth{
+			{Name: "second", Limit: ratelimit.Limit{Rate: time.Second, Capacity: 1}},
+			{Name: "hour", Limit: ratelimit.Limit{Rate: time.Hour, Capacity: 5}},
+		},
+	})
+	assert.NoError(err)
+
+	codes := make([]int, 0, 2)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rw := httptest.NewRecorder()
+		mw(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		codes = append(codes, rw.Code)
+	}
+	assert.Equal([]int{200, 429}, codes)
+	// one script call per request, no refunds
+	assert.Equal([]string{"EVALSHA", "EVAL", "EVALSHA"}, f.commandNames())
+
+	f.mu.Lock()
+	b := f.buckets["rl:127.0.0.1"]
+	f.mu.Unlock()
+	if assert.NotNil(b) {
+		// the key lives until the slowest limit is full again
+		assert.InDelta(time.Hour, b.ttl, float64(time.Second))
+		assert.Equal(4.0, b.parts[1].tokens)
+	}
+}
+
+func TestRedisStore_RejectsSubMicrosecondRate(t *testing.T) {
+	assert := a.New(t)
+
+	s := newTestRedisStore(t, newFakeRedis(t), ratelimit.RedisStoreConfig{})
+	_, err := s.Take(context.Background(), "k", ratelimit.Limit{Rate: time.Nanosecond, Capacity: 2}, 1, time.Now())
+	assert.Error(err)
+}
+
+func TestRedisStore_RejectsUnsupportedAlgorithm(t *testing.T) {
+	assert := a.New(t)
+
+	s := newTestRedisStore(t, newFakeRedis(t), ratelimit.RedisStoreConfig{})
+	_, err := s.Take(context.Background(), "k", ratelimit.Limit{Rate: time.Second, Capacity: 2, Algorithm: ratelimit.SlidingWindow}, 1, time.Now())
+	assert.ErrorContains(err, "sliding-window")
+}
+
+func TestRedisStore_MiddlewareRejectsUnsupportedAlgorithm(t *testing.T) {
+	assert := a.New(t)
+
+	s := newTestRedisStore(t, newFakeRedis(t), ratelimit.RedisStoreConfig{})
+	for _, alg := range []ratelimit.Algorithm{ratelimit.SlidingWindow, ratelimit.SlidingLog, ratelimit.GCRA} {
+		_, err := ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{RequestsPerMinute: 2, Algorithm: alg, Context: context.Background(), Store: s})
+		assert.ErrorContains(err, alg.String())
+	}
+
+	// limits of route policies are checked as well
+	_, err := ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{
+		RequestsPerMinute: 2,
+		Context:           context.Background(),
+		Store:             s,
+		Policies: []ratelimit.RoutePolicy{{
+			Name:    "login",
+			Pattern: "POST /login",
+			Limits:  []ratelimit.Bandwidth{{Name: "login", Limit: ratelimit.Limit{Rate: time.Second, Capacity: 1, Algorithm: ratelimit.GCRA}}},
+		}},
+	})
+	assert.ErrorContains(err, `policy "login"`)
+}
+
+func TestRedisStore_SharedAcrossMiddlewares(t *testing.T) {
+	assert := a.New(t)
+
+	s := newTestRedisStore(t, newFakeRedis(t), ratelimit.RedisStoreConfig{})
+
+	// two replicas of the same service enforce a single limit
+	var replicas []func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc)
+	for i := 0; i < 2; i++ {
+		mw, err := ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{RequestsPerMinute: 2, Context: context.Background(), Store: s})
+		assert.NoError(err)
+		replicas = append(replicas, mw)
+	}
+
+	codes := make([]int, 0, 3)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rw := httptest.NewRecorder()
+		replicas[i%2](rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		codes = append(codes, rw.Code)
+	}
+	assert.Equal([]int{200, 200, 429}, codes)
+}
+
+// newStalledRedis returns the address of a server that accepts connections
+// but never replies.
+func newStalledRedis(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	})
+	return ln.Addr().String()
+}
+
+func TestRedisStore_ReadTimeout(t *testing.T) {
+	assert := a.New(t)
+
+	s, err := ratelimit.NewRedisStore(ratelimit.RedisStoreConfig{Addr: newStalledRedis(t), ReadTimeout: 10 * time.Millisecond})
+	assert.NoError(err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	start := time.Now()
+	_, err = s.Take(context.Background(), "k", ratelimit.Limit{Rate: time.Second, Capacity: 2}, 1, time.Now())
+	assert.Error(err)
+	assert.Less(time.Since(start), time.Second)
+}
+
+func TestRedisStore_AbortsOnCancel(t *testing.T) {
+	assert := a.New(t)
+
+	s, err := ratelimit.NewRedisStore(ratelimit.RedisStoreConfig{Addr: newStalledRedis(t), ReadTimeout: time.Minute})
+	assert.NoError(err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	// a context without deadline that is cancelled while waiting for the reply
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = s.Take(ctx, "k", ratelimit.Limit{Rate: time.Second, Capacity: 2}, 1, time.Now())
+	assert.ErrorIs(err, context.Canceled)
+	assert.Less(time.Since(start), time.Second)
+}
+
+func TestRedisStore_MiddlewareFailsClosedOnRequestTimeout(t *testing.T) {
+	assert := a.New(t)
+
+	s, err := ratelimit.NewRedisStore(ratelimit.RedisStoreConfig{Addr: newStalledRedis(t), ReadTimeout: time.Minute})
+	assert.NoError(err)
+	t.Cleanup(func() { _ = s.Close() })
+	mw, err := ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{RequestsPerMinute: 2, Context: context.Background(), Store: s})
+	assert.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", "/test", nil).WithContext(ctx)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	mw(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+	assert.Equal(http.StatusTooManyRequests, rw.Code)
+	assert.Less(time.Since(start), time.Second)
+}
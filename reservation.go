@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reservation holds tokens taken ahead of time by RateLimiter.Reserve. The
+// holder may act once Delay has passed, or must call Cancel to give the
+// tokens back if it does not act at all.
+type Reservation struct {
+	rl        *RateLimiter
+	reserver  Reserver
+	key       string
+	n         int
+	timeToAct time.Time
+
+	mu       sync.Mutex
+	canceled bool
+}
+
+// Delay returns how long the holder has to wait before acting. It is zero
+// if the tokens are available right away.
+func (r *Reservation) Delay() time.Duration {
+	return r.DelayFrom(time.Now())
+}
+
+// DelayFrom returns how long the holder has to wait from now on before
+// acting.
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+	if !now.Before(r.timeToAct) {
+		return 0
+	}
+	return r.timeToAct.Sub(now)
+}
+
+// Cancel returns the reserved tokens to the buckets. Tokens whose time has
+// come are considered used, so Cancel is a no-op after Delay has passed.
+// Cancelling more than once has no further effect.
+func (r *Reservation) Cancel() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.canceled || !time.Now().Before(r.timeToAct) {
+		return
+	}
+	r.canceled = true
+	r.rl.refund(context.WithoutCancel(r.rl.ctx), r.reserver, r.key, r.n)
+}
+
+// Reserve is shorthand for ReserveN(ctx, key, 1).
+func (rl *RateLimiter) Reserve(ctx context.Context, key string) (*Reservation, error) {
+	return rl.ReserveN(ctx, key, 1)
+}
+
+// ReserveN takes n tokens for key, including tokens that only become
+// available in the future, and returns a Reservation that tells the caller
+// how long to wait before acting. Unlike AllowN it does not reject
+// requests; later requests for key wait for the reserved tokens as well.
+//
+// The store must implement Reserver; MemoryStore supports the TokenBucket
+// and GCRA algorithms. An error is returned for other stores and
+// algorithms and if n exceeds the capacity of a limit.
+func (rl *RateLimiter) ReserveN(ctx context.Context, key string, n int) (*Reservation, error) {
+	return rl.reserve(ctx, key, n, math.MaxInt64)
+}
+
+// reserve implements ReserveN. Nothing is reserved if the tokens are not
+// available within maxWait.
+func (rl *RateLimiter) reserve(ctx context.Context, key string, n int, maxWait time.Duration) (*Reservation, error) {
+	if rl.isClosed() {
+		return nil, ErrClosed
+	}
+	reserver, ok := rl.store.(Reserver)
+	if !ok {
+		return nil, fmt.Errorf("store %T does not support reservations", rl.store)
+	}
+	if strings.TrimSpace(key) == "" {
+		return nil, fmt.Errorf("empty key")
+	}
+	for _, bw := range rl.bandwidths {
+		if n < 0 || n > bw.Capacity {
+			return nil, fmt.Errorf("cost %d exceeds capacity %d of limit %q", n, bw.Capacity, bw.Name)
+		}
+	}
+
+	now := time.Now()
+	results, err := reserver.Reserve(ctx, rl.prefix+key, rl.limits, n, now, maxWait)
+	if err == nil && len(results) != len(rl.limits) {
+		err = fmt.Errorf("store returned %d results for %d limits", len(results), len(rl.limits))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve tokens: %w", err)
+	}
+	var delay time.Duration
+	for i, tr := range results {
+		if !tr.Allowed {
+			bw := rl.bandwidths[i]
+			return nil, fmt.Errorf("waiting for %d tokens of limit %q would take %s, longer than %s", n, bw.Name, tr.RetryAfter, maxWait)
+		}
+		delay = max(delay, tr.RetryAfter)
+	}
+
+	return &Reservation{rl: rl, reserver: reserver, key: key, n: n, timeToAct: now.Add(delay)}, nil
+}
+
+// refund returns n reserved tokens of key to all limits.
+func (rl *RateLimiter) refund(ctx context.Context, reserver Reserver, key string, n int) {
+	if err := reserver.RefillAll(ctx, rl.prefix+key, rl.limits, n); err != nil {
+		rl.logEvent(ctx, slog.LevelError, "failed to return tokens to rate limiter store", ReasonStoreError, key, slog.Any("error", err))
+	}
+}
+
+// Wait is shorthand for WaitN(ctx, key, 1).
+func (rl *RateLimiter) Wait(ctx context.Context, key string) error {
+	return rl.WaitN(ctx, key, 1)
+}
+
+// WaitN blocks until n tokens are available for key and takes them. It
+// returns an error without waiting if the tokens would not be available
+// before the deadline of ctx, and returns ctx.Err() and gives the tokens
+// back if ctx is done while waiting. See ReserveN for the supported stores
+// and algorithms.
+func (rl *RateLimiter) WaitN(ctx context.Context, key string, n int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	maxWait := time.Duration(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		maxWait = time.Until(deadline)
+	}
+
+	r, err := rl.reserve(ctx, key, n, maxWait)
+	if err != nil {
+		return err
+	}
+	delay := r.Delay()
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func newReservationLimiter(t *testing.T, alg Algorithm) *RateLimiter {
+	rl, err := NewCompositeRateLimiter(context.Background(),
+		Bandwidth{Name: "default", Limit: Limit{Rate: time.Hour, Capacity: 2, Algorithm: alg}})
+	if err != nil {
+		t.Fatalf("failed to create rate limiter: %v", err)
+	}
+	return rl
+}
+
+func TestMemoryStore_Reserve(t *testing.T) {
+	for _, alg := range []Algorithm{TokenBucket, GCRA} {
+		t.Run(alg.String(), func(t *testing.T) {
+			assert := a.New(t)
+			ctx := context.Background()
+			s := NewMemoryStore(MemoryStoreConfig{})
+			limit := Limit{Rate: time.Second, Capacity: 2, Algorithm: alg}
+			now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+			reserve := func(n int, maxWait time.Duration) TakeResult {
+				res, err := s.Reserve(ctx, "k", []Limit{limit}, n, now, maxWait)
+				assert.NoError(err)
+				assert.Len(res, 1)
+				return res[0]
+			}
+
+			for i, want := range []time.Duration{0, 0, time.Second, 2 * time.Second} {
+				res := reserve(1, time.Minute)
+				assert.True(res.Allowed, "reservation %d", i)
+				assert.Equal(want, res.RetryAfter, "reservation %d", i)
+				assert.Equal(max(1-i, 0), res.Remaining, "reservation %d", i)
+			}
+
+			// requests wait for the reserved tokens, too
+			res, err := s.Take(ctx, "k", limit, 1, now)
+			assert.NoError(err)
+			assert.False(res.Allowed)
+			assert.Equal(3*time.Second, res.RetryAfter)
+
+			// nothing is reserved beyond maxWait
+			res = reserve(1, 2*time.Second)
+			assert.False(res.Allowed)
+			assert.Equal(3*time.Second, res.RetryAfter)
+
+			// returning a reservation shortens the wait
+			assert.NoError(s.RefillAll(ctx, "k", []Limit{limit}, 1))
+			res, err = s.Take(ctx, "k", limit, 1, now)
+			assert.NoError(err)
+			assert.False(res.Allowed)
+			assert.Equal(2*time.Second, res.RetryAfter)
+
+			assert.False(reserve(3, time.Minute).Allowed)
+		})
+	}
+}
+
+func TestMemoryStore_ReserveAllOrNothing(t *testing.T) {
+	assert := a.New(t)
+	ctx := context.Background()
+
+	s := NewMemoryStore(MemoryStoreConfig{})
+	limits := []Limit{{Rate: time.Second, Capacity: 2}, {Rate: time.Hour, Capacity: 2, Algorithm: GCRA}}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	res, err := s.Reserve(ctx, "k", limits, 2, now, time.Minute)
+	assert.NoError(err)
+	assert.True(res[0].Allowed && res[1].Allowed)
+
+	// the second limit rejects, so the first one keeps its tokens
+	res, err = s.Reserve(ctx, "k", limits, 1, now.Add(2*time.Second), time.Minute)
+	assert.NoError(err)
+	assert.True(res[0].Allowed)
+	assert.False(res[1].Allowed)
+	c := s.load("k").(*compositeEntry)
+	assert.Equal(2, c.buckets[0].(*tokenBucketEntry).tokens(now.Add(2*time.Second)))
+}
+
+func TestMemoryStore_ReserveUnsupportedAlgorithm(t *testing.T) {
+	assert := a.New(t)
+
+	s := NewMemoryStore(MemoryStoreConfig{})
+	_, err := s.Reserve(context.Background(), "k", []Limit{{Rate: time.Second, Capacity: 2, Algorithm: SlidingWindow}}, 1, time.Now(), time.Minute)
+	assert.Error(err)
+}
+
+func TestRateLimiter_Reserve(t *testing.T) {
+	for _, alg := range []Algorithm{TokenBucket, GCRA} {
+		t.Run(alg.String(), func(t *testing.T) {
+			assert := a.New(t)
+			ctx := context.Background()
+			rl := newReservationLimiter(t, alg)
+
+			r, err := rl.ReserveN(ctx, "k", 2)
+			assert.NoError(err)
+			assert.Zero(r.Delay())
+
+			r, err = rl.Reserve(ctx, "k")
+			assert.NoError(err)
+			assert.InDelta(time.Hour, r.Delay(), float64(time.Second))
+			assert.False(rl.Allow("k"))
+
+			// cancelling gives the token back; the first hour-long wait is
+			// for that token again
+			r.Cancel()
+			r.Cancel()
+			r, err = rl.Reserve(ctx, "k")
+			assert.NoError(err)
+			assert.InDelta(time.Hour, r.Delay(), float64(time.Second))
+
+			_, err = rl.ReserveN(ctx, "k", 3)
+			assert.Error(err)
+		})
+	}
+}
+
+func TestRateLimiter_ReserveComposite(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewCompositeRateLimiter(context.Background(),
+		Bandwidth{Name: "second", Limit: Limit{Rate: time.Second, Capacity: 1}},
+		Bandwidth{Name: "hour", Limit: Limit{Rate: time.Hour, Capacity: 2}},
+	)
+	assert.NoError(err)
+
+	r, err := rl.Reserve(context.Background(), "k")
+	assert.NoError(err)
+	assert.Zero(r.Delay())
+	r, err = rl.Reserve(context.Background(), "k")
+	assert.NoError(err)
+	assert.InDelta(time.Second, r.Delay(), float64(100*time.Millisecond))
+	// the slowest limit decides
+	r, err = rl.Reserve(context.Background(), "k")
+	assert.NoError(err)
+	assert.InDelta(time.Hour, r.Delay(), float64(time.Second))
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	assert := a.New(t)
+
+	rl, err := NewCompositeRateLimiter(context.Background(),
+		Bandwidth{Name: "default", Limit: Limit{Rate: 20 * time.Millisecond, Capacity: 1}})
+	assert.NoError(err)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(rl.Wait(context.Background(), "k"))
+	}
+	assert.GreaterOrEqual(time.Since(start), 35*time.Millisecond)
+}
+
+func TestRateLimiter_WaitDeadline(t *testing.T) {
+	assert := a.New(t)
+	rl := newReservationLimiter(t, TokenBucket)
+
+	assert.NoError(rl.WaitN(context.Background(), "k", 2))
+
+	// the next token is an hour away: fail right away without reserving it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.Error(rl.Wait(ctx, "k"))
+	assert.Less(time.Since(start), 500*time.Millisecond)
+	assert.Equal(0, rl.store.(*MemoryStore).load("k").(*tokenBucketEntry).tokens(time.Now()))
+}
+
+func TestRateLimiter_WaitCancelled(t *testing.T) {
+	assert := a.New(t)
+	rl := newReservationLimiter(t, GCRA)
+
+	assert.NoError(rl.WaitN(context.Background(), "k", 2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	assert.ErrorIs(rl.Wait(ctx, "k"), context.Canceled)
+
+	// the token was given back
+	r, err := rl.Reserve(context.Background(), "k")
+	assert.NoError(err)
+	assert.InDelta(time.Hour, r.Delay(), float64(time.Second))
+
+	assert.ErrorIs(rl.Wait(ctx, "k"), context.Canceled)
+}
+
+func TestRateLimiter_ReserveRequiresReserver(t *testing.T) {
+	assert := a.New(t)
+	rl := newReservationLimiter(t, TokenBucket)
+	rl.store = struct{ Store }{rl.store}
+
+	_, err := rl.Reserve(context.Background(), "k")
+	assert.Error(err)
+	assert.Error(rl.Wait(context.Background(), "k"))
+}
@@ -0,0 +1,207 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// respError is an error reply ("-ERR ...") returned by a RESP server. It
+// does not indicate a broken connection.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// maxRESPBulkLen bounds the size of bulk strings accepted from the server,
+// and thereby the memory a single bad reply can make us allocate. Replies
+// handled by this package are numbers and keys; anything larger indicates
+// a protocol error.
+const maxRESPBulkLen = 8 * 1024
+
+// respConn is a single connection speaking RESP2.
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	// readTimeout and writeTimeout bound each command, in addition to the
+	// deadline of its context.
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func newRESPConn(conn net.Conn, readTimeout, writeTimeout time.Duration) *respConn {
+	return &respConn{
+		conn:         conn,
+		r:            bufio.NewReader(conn),
+		w:            bufio.NewWriter(conn),
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// do sends a command and reads its reply. Replies are returned as string
+// (simple and bulk strings), int64, []any, nil or respError. Any other
+// returned error means the connection is no longer usable.
+//
+// The command is aborted when ctx is done, even if ctx has no deadline, by
+// moving the deadline of the connection into the past.
+func (c *respConn) do(ctx context.Context, args ...string) (reply any, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer func() {
+		if !stop() && err == nil {
+			// The deadline may have been moved after the reply was read;
+			// report the cancellation so the connection is discarded.
+			reply, err = nil, ctx.Err()
+		}
+	}()
+
+	err = c.conn.SetWriteDeadline(c.deadline(ctx, c.writeTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %w", err)
+	}
+	err = writeRESPCommand(c.w, args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write command: %w", c.cause(ctx, err))
+	}
+	err = c.w.Flush()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write command: %w", c.cause(ctx, err))
+	}
+
+	err = c.conn.SetReadDeadline(c.deadline(ctx, c.readTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %w", err)
+	}
+	reply, err = readRESPReply(c.r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read reply: %w", c.cause(ctx, err))
+	}
+	return reply, nil
+}
+
+// deadline returns the earlier of the deadline of ctx and now + timeout.
+func (c *respConn) deadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// cause returns the error of ctx if the I/O error err was caused by its
+// cancellation.
+func (c *respConn) cause(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (c *respConn) close() error {
+	return c.conn.Close()
+}
+
+// writeRESPCommand encodes args as an array of bulk strings.
+func writeRESPCommand(w *bufio.Writer, args []string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRESPReply decodes a single RESP2 reply.
+func readRESPReply(r *bufio.Reader) (any, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply line")
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer reply: %w", err)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		if n > maxRESPBulkLen {
+			return nil, fmt.Errorf("bulk string too large: %d", n)
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return nil, errors.New("bulk string not terminated by CRLF")
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		out := make([]any, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			v, err := readRESPReply(r)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply type %q", line[0])
+	}
+}
+
+// readRESPLine reads a CRLF terminated line and returns it without the
+// terminator.
+func readRESPLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("reply line not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,21 @@
+package ratelimit
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func TestReadRESPReply_RejectsLargeBulkString(t *testing.T) {
+	assert := a.New(t)
+
+	// the length is rejected before anything is allocated for it
+	_, err := readRESPReply(bufio.NewReader(strings.NewReader("$536870912\r\n")))
+	assert.ErrorContains(err, "bulk string too large")
+
+	reply, err := readRESPReply(bufio.NewReader(strings.NewReader("$3\r\nkey\r\n")))
+	assert.NoError(err)
+	assert.Equal("key", reply)
+}
@@ -0,0 +1,161 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RoutePolicy applies its own limits to the requests matching Pattern. See
+// RateLimiterConfig.Policies. Every policy keeps its own entry per client,
+// and the default store makes room for MaxClientIpsPerMinute more entries
+// per policy.
+type RoutePolicy struct {
+	// Name identifies the policy. It is reported as Decision.Route and
+	// separates the store entries of the policy from those of other
+	// policies. Names must be unique, must not be "default" and consist of
+	// letters, digits, '-', '_' and '.'.
+	Name string
+	// Pattern selects the requests the policy applies to, in the syntax
+	// of http.ServeMux: "[METHOD ][HOST]/[PATH]", e.g. "POST /login" or
+	// "GET /export/{format}".
+	Pattern string
+	// Limits are enforced on every key for requests matching Pattern. The
+	// names of the limits are sent in the RateLimit headers.
+	Limits []Bandwidth
+}
+
+// route is a policy resolved to the rate limiter enforcing it.
+type route struct {
+	name    string
+	limiter *RateLimiter
+}
+
+// routeTable matches requests to route policies. It uses an http.ServeMux
+// for the lookup only, so patterns and precedence follow its rules: the
+// most specific pattern wins, and patterns that overlap without one being
+// more specific than the other are rejected.
+type routeTable struct {
+	mux      *http.ServeMux
+	routes   map[string]*route
+	fallback *route
+}
+
+// newRouteTable creates the routes for policies. Their rate limiters share
+// the store, logging and metrics of fallback, which handles requests that
+// match no policy.
+func newRouteTable(fallback *RateLimiter, policies []RoutePolicy) (*routeTable, error) {
+	t := &routeTable{
+		mux:      http.NewServeMux(),
+		routes:   make(map[string]*route, len(policies)),
+		fallback: &route{name: defaultPolicyName, limiter: fallback},
+	}
+	names := make(map[string]bool, len(policies))
+	for _, p := range policies {
+		if !validBandwidthName(p.Name) || p.Name == defaultPolicyName {
+			return nil, fmt.Errorf("invalid policy name %q", p.Name)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("duplicate policy name %q", p.Name)
+		}
+		names[p.Name] = true
+		if err := validateBandwidths(p.Limits); err != nil {
+			return nil, fmt.Errorf("policy %q: invalid limit: %w", p.Name, err)
+		}
+		if err := handlePattern(t.mux, p.Pattern); err != nil {
+			return nil, fmt.Errorf("policy %q: %w", p.Name, err)
+		}
+		t.routes[p.Pattern] = &route{name: p.Name, limiter: fallback.derive(p.Name+"\x00", p.Limits)}
+	}
+	return t, nil
+}
+
+// handlePattern registers pattern with mux, which panics for invalid and
+// conflicting patterns.
+func handlePattern(mux *http.ServeMux, pattern string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid pattern: %v", r)
+		}
+	}()
+	// The handler is never called; only the matched pattern is used.
+	mux.Handle(pattern, http.NotFoundHandler())
+	return nil
+}
+
+// match returns the route of r. For requests with an unclean path or a
+// missing trailing slash the mux reports the pattern that matches after
+// the redirect, so "//login" cannot be used to escape the policy of
+// "/login" and "/export" gets the policy of "GET /export/".
+func (t *routeTable) match(r *http.Request) *route {
+	if len(t.routes) == 0 {
+		return t.fallback
+	}
+	pattern := matchPattern(t.mux, r, func(pattern string) bool { return t.routes[pattern] != nil })
+	if rt := t.routes[pattern]; rt != nil {
+		return rt
+	}
+	return t.fallback
+}
+
+// matchPattern returns the pattern of mux that matches r, including
+// requests the mux redirects. Older Go releases report the path of a
+// trailing-slash redirect ("/export/") instead of the pattern it leads to
+// ("GET /export/"); a result that is not registered is such a path and
+// is looked up again.
+func matchPattern(mux *http.ServeMux, r *http.Request, registered func(pattern string) bool) string {
+	_, pattern := mux.Handler(r)
+	if pattern == "" || registered(pattern) || !strings.HasPrefix(pattern, "/") {
+		return pattern
+	}
+	redirected := r.WithContext(r.Context())
+	u := *r.URL
+	u.Path, u.RawPath = pattern, ""
+	redirected.URL = &u
+	_, pattern = mux.Handler(redirected)
+	return pattern
+}
+
+// checkStore returns an error if the shared store cannot enforce the
+// algorithm of one of the limits.
+func (t *routeTable) checkStore() error {
+	supporter, ok := t.fallback.limiter.store.(AlgorithmSupporter)
+	if !ok {
+		return nil
+	}
+	check := func(rt *route) error {
+		for _, bw := range rt.limiter.bandwidths {
+			if !supporter.Supports(bw.Algorithm) {
+				return fmt.Errorf("store %T does not support algorithm %s of limit %q", rt.limiter.store, bw.Algorithm, bw.Name)
+			}
+		}
+		return nil
+	}
+	if err := check(t.fallback); err != nil {
+		return err
+	}
+	for _, rt := range t.routes {
+		if err := check(rt); err != nil {
+			return fmt.Errorf("policy %q: %w", rt.name, err)
+		}
+	}
+	return nil
+}
+
+// derive returns a rate limiter that enforces bandwidths on keys prefixed
+// with prefix, the name of a policy followed by a NUL byte or empty for
+// the default policy. It shares the store, logging and metrics of rl.
+func (rl *RateLimiter) derive(prefix string, bandwidths []Bandwidth) *RateLimiter {
+	d := &RateLimiter{
+		store:          rl.store,
+		prefix:         prefix,
+		ctx:            rl.ctx,
+		trustedProxies: rl.trustedProxies,
+		logger:         rl.logger,
+		logSampler:     rl.logSampler,
+		metrics:        rl.metrics,
+		closed:         rl.closed,
+	}
+	d.setBandwidths(bandwidths)
+	return d
+}
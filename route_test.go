@@ -0,0 +1,177 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+func newRouteMiddleware(t *testing.T, decisions *[]Decision) func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 3,
+		Context:           context.Background(),
+		Policies: []RoutePolicy{
+			{Name: "login", Pattern: "POST /login", Limits: []Bandwidth{{Name: "login", Limit: Limit{Rate: time.Minute, Capacity: 1}}}},
+			{Name: "export", Pattern: "/export/", Limits: []Bandwidth{{Name: "export", Limit: Limit{Rate: time.Minute, Capacity: 2}}}},
+			{Name: "export-csv", Pattern: "GET /export/csv", Limits: []Bandwidth{{Name: "csv", Limit: Limit{Rate: time.Minute, Capacity: 1}}}},
+		},
+		OnDecision: func(r *http.Request, d Decision) { *decisions = append(*decisions, d) },
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	return middleware
+}
+
+func serveRoute(middleware func(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc), method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rw := httptest.NewRecorder()
+	middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+	return rw
+}
+
+func TestRateLimitMiddleware_Policies(t *testing.T) {
+	assert := a.New(t)
+
+	var decisions []Decision
+	middleware := newRouteMiddleware(t, &decisions)
+
+	assert.Equal(http.StatusOK, serveRoute(middleware, "POST", "/login").Code)
+	rw := serveRoute(middleware, "POST", "/login")
+	assert.Equal(http.StatusTooManyRequests, rw.Code)
+	assert.Equal(`"login";q=1;w=60`, rw.Header().Get("RateLimit-Policy"))
+
+	// other methods and paths have their own buckets
+	rw = serveRoute(middleware, "GET", "/login")
+	assert.Equal(http.StatusOK, rw.Code)
+	assert.Equal(`"default";r=2;t=20`, rw.Header().Get("RateLimit"))
+	assert.Equal(http.StatusOK, serveRoute(middleware, "GET", "/export/json").Code)
+
+	// the more specific pattern wins
+	assert.Equal(http.StatusOK, serveRoute(middleware, "GET", "/export/csv").Code)
+	assert.Equal(http.StatusTooManyRequests, serveRoute(middleware, "GET", "/export/csv").Code)
+	assert.Equal(http.StatusOK, serveRoute(middleware, "POST", "/export/csv").Code)
+
+	routes := make([]string, 0, len(decisions))
+	for _, d := range decisions {
+		routes = append(routes, d.Route)
+	}
+	assert.Equal([]string{"login", "login", "default", "export", "export-csv", "export-csv", "export"}, routes)
+}
+
+func TestRateLimitMiddleware_PoliciesCleanPath(t *testing.T) {
+	assert := a.New(t)
+
+	var decisions []Decision
+	middleware := newRouteMiddleware(t, &decisions)
+
+	assert.Equal(http.StatusOK, serveRoute(middleware, "POST", "/login").Code)
+	// unclean paths are matched like their clean form
+	for _, path := range []string{"//login", "/x/../login", "/./login"} {
+		assert.Equal(http.StatusTooManyRequests, serveRoute(middleware, "POST", path).Code, path)
+	}
+	// a missing trailing slash matches the subtree
+	serveRoute(middleware, "GET", "/export")
+	assert.Equal("export", decisions[len(decisions)-1].Route)
+}
+
+func TestRateLimitMiddleware_PoliciesTrailingSlash(t *testing.T) {
+	assert := a.New(t)
+
+	var decisions []Decision
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 3,
+		Context:           context.Background(),
+		Policies: []RoutePolicy{
+			{Name: "export", Pattern: "GET /export/", Limits: []Bandwidth{{Name: "export", Limit: Limit{Rate: time.Minute, Capacity: 1}}}},
+		},
+		OnDecision: func(r *http.Request, d Decision) { decisions = append(decisions, d) },
+	})
+	assert.NoError(err)
+
+	assert.Equal(http.StatusOK, serveRoute(middleware, "GET", "/export").Code)
+	assert.Equal("export", decisions[0].Route)
+	// the redirected request shares the bucket
+	assert.Equal(http.StatusTooManyRequests, serveRoute(middleware, "GET", "/export/").Code)
+	assert.Equal("export", decisions[1].Route)
+}
+
+func TestRateLimitMiddleware_PoliciesScaleMaxClients(t *testing.T) {
+	assert := a.New(t)
+
+	limits := []Bandwidth{{Name: "l", Limit: Limit{Rate: time.Minute, Capacity: 5}}}
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute:     5,
+		MaxClientIpsPerMinute: 1,
+		Context:               context.Background(),
+		Policies: []RoutePolicy{
+			{Name: "login", Pattern: "/login", Limits: limits},
+			{Name: "report", Pattern: "/report", Limits: limits},
+		},
+	})
+	assert.NoError(err)
+
+	// one client fits into every policy
+	for _, path := range []string{"/", "/login", "/report"} {
+		assert.Equal(http.StatusOK, serveRoute(middleware, "GET", path).Code, path)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.2:12345"
+	rw := httptest.NewRecorder()
+	middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+	assert.Equal(http.StatusTooManyRequests, rw.Code)
+}
+
+func TestRateLimitMiddleware_PoliciesShareStore(t *testing.T) {
+	assert := a.New(t)
+
+	store := NewMemoryStore(MemoryStoreConfig{})
+	middleware, err := RateLimitMiddleware(RateLimiterConfig{
+		RequestsPerMinute: 3,
+		Context:           context.Background(),
+		Store:             store,
+		Policies: []RoutePolicy{
+			{Name: "login", Pattern: "/login", Limits: []Bandwidth{{Name: "login", Limit: Limit{Rate: time.Minute, Capacity: 1}}}},
+			{Name: "day", Pattern: "/report", Limits: []Bandwidth{{Name: "day", Limit: Limit{Rate: time.Hour, Capacity: 24}}}},
+		},
+	})
+	assert.NoError(err)
+
+	serveRoute(middleware, "GET", "/")
+	serveRoute(middleware, "GET", "/login")
+	serveRoute(middleware, "GET", "/report")
+
+	n, err := store.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(3, n)
+	assert.NotNil(store.load("127.0.0.1"))
+	assert.NotNil(store.load("login\x00127.0.0.1"))
+	assert.NotNil(store.load("day\x00127.0.0.1"))
+}
+
+func TestRateLimitMiddleware_InvalidPolicies(t *testing.T) {
+	assert := a.New(t)
+
+	limits := []Bandwidth{{Name: "l", Limit: Limit{Rate: time.Second, Capacity: 1}}}
+	for name, policies := range map[string][]RoutePolicy{
+		"invalid name":    {{Name: "a b", Pattern: "/a", Limits: limits}},
+		"default name":    {{Name: "default", Pattern: "/a", Limits: limits}},
+		"duplicate name":  {{Name: "a", Pattern: "/a", Limits: limits}, {Name: "a", Pattern: "/b", Limits: limits}},
+		"no limits":       {{Name: "a", Pattern: "/a"}},
+		"invalid pattern": {{Name: "a", Pattern: "a", Limits: limits}},
+		"duplicate":       {{Name: "a", Pattern: "/a", Limits: limits}, {Name: "b", Pattern: "/a", Limits: limits}},
+		"conflicting":     {{Name: "a", Pattern: "GET /a/{x}", Limits: limits}, {Name: "b", Pattern: "/{y}/b", Limits: limits}},
+	} {
+		_, err := RateLimitMiddleware(RateLimiterConfig{
+			RequestsPerMinute: 3,
+			Context:           context.Background(),
+			Policies:          policies,
+		})
+		assert.Error(err, name)
+	}
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxSlidingLogCapacity bounds the memory of a single sliding log entry to
+// maxSlidingLogCapacity * 8 bytes. The sliding log is meant for low-volume
+// limits; use SlidingWindow for large ones.
+const maxSlidingLogCapacity = 10000
+
+// slidingLog is a ring buffer holding the times of the requests in the
+// current window, oldest first. Its size is fixed to the capacity of the
+// limit, so memory per key is bounded.
+type slidingLog struct {
+	times []int64 // Unix nanoseconds
+	head  int     // index of the oldest entry
+	count int
+}
+
+// validateSlidingLog reports an error if limit cannot be enforced with a
+// sliding log.
+func validateSlidingLog(limit Limit) error {
+	if limit.Capacity > maxSlidingLogCapacity {
+		return fmt.Errorf("capacity %d exceeds the sliding log maximum of %d", limit.Capacity, maxSlidingLogCapacity)
+	}
+	return nil
+}
+
+// at returns the i-th oldest entry.
+func (l *slidingLog) at(i int) int64 {
+	return l.times[(l.head+i)%len(l.times)]
+}
+
+// push appends t as the newest entry. The log must not be full.
+func (l *slidingLog) push(t int64) {
+	l.times[(l.head+l.count)%len(l.times)] = t
+	l.count++
+}
+
+// expire drops entries at or before cutoff.
+func (l *slidingLog) expire(cutoff int64) {
+	for l.count > 0 && l.times[l.head] <= cutoff {
+		l.head = (l.head + 1) % len(l.times)
+		l.count--
+	}
+}
+
+// live returns the number of entries after cutoff without dropping any.
+func (l *slidingLog) live(cutoff int64) int {
+	for i := 0; i < l.count; i++ {
+		if l.at(i) > cutoff {
+			return l.count - i
+		}
+	}
+	return 0
+}
+
+// takeSlidingLog records n requests at now if fewer than Capacity - n
+// requests were recorded within the last window of Capacity * Rate. The
+// caller must hold v.mu.
+func (v *Visitor) takeSlidingLog(limit Limit, n int, now time.Time) TakeResult {
+	l := v.log
+	window := slidingWindowLength(limit)
+	l.expire(now.Add(-window).UnixNano())
+
+	var res TakeResult
+	if n <= limit.Capacity && l.count+n <= limit.Capacity {
+		for i := 0; i < n; i++ {
+			l.push(now.UnixNano())
+		}
+		// Cleanup must not forget requests that still count, so the entry
+		// is considered active until the newest one leaves the window.
+		v.lastToken = now.Add(window)
+		res.Allowed = true
+	} else if n <= limit.Capacity {
+		// Enough of the oldest requests have to leave the window.
+		oldest := l.at(l.count + n - limit.Capacity - 1)
+		res.RetryAfter = time.Unix(0, oldest).Add(window).Sub(now)
+	}
+	res.Remaining = limit.Capacity - l.count
+	if l.count > 0 {
+		res.ResetAfter = max(time.Unix(0, l.at(l.count-1)).Add(window).Sub(now), 0)
+	}
+	return res
+}
+
+// slidingLogAvailable returns how many requests the log could record at
+// now without modifying v. The caller must hold v.mu.
+func (v *Visitor) slidingLogAvailable(limit Limit, now time.Time) int {
+	cutoff := now.Add(-slidingWindowLength(limit)).UnixNano()
+	return max(limit.Capacity-v.log.live(cutoff), 0)
+}
+
+// refundSlidingLog removes the newest n entries. The caller must hold v.mu.
+func (v *Visitor) refundSlidingLog(n int) {
+	v.log.count = max(v.log.count-n, 0)
+}
@@ -0,0 +1,122 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+
+	ratelimit "github.com/stfsy/go-rate-limit"
+)
+
+func TestSlidingLog_ExactRollingWindow(t *testing.T) {
+	assert := a.New(t)
+
+	// at most 5 requests in any rolling 15 minutes
+	limit := ratelimit.Limit{Rate: 3 * time.Minute, Capacity: 5, Algorithm: ratelimit.SlidingLog}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	epoch := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		res, err := s.Take(ctx, "k", limit, 1, epoch.Add(time.Duration(i)*time.Minute))
+		assert.NoError(err)
+		assert.True(res.Allowed)
+		assert.Equal(4-i, res.Remaining)
+	}
+
+	// the oldest request leaves the window at 15m
+	res, err := s.Take(ctx, "k", limit, 1, epoch.Add(14*time.Minute))
+	assert.NoError(err)
+	assert.Equal(ratelimit.TakeResult{Remaining: 0, ResetAfter: 5 * time.Minute, RetryAfter: time.Minute}, res)
+
+	// exactly one slot opened up
+	res, err = s.Take(ctx, "k", limit, 1, epoch.Add(15*time.Minute))
+	assert.NoError(err)
+	assert.True(res.Allowed)
+	res, err = s.Take(ctx, "k", limit, 1, epoch.Add(15*time.Minute))
+	assert.NoError(err)
+	assert.False(res.Allowed)
+	assert.Equal(time.Minute, res.RetryAfter)
+
+	// taking 3 at once has to wait for the three oldest requests
+	res, err = s.Take(ctx, "k", limit, 3, epoch.Add(15*time.Minute))
+	assert.NoError(err)
+	assert.False(res.Allowed)
+	assert.Equal(3*time.Minute, res.RetryAfter)
+
+	// more than the capacity never fits
+	res, err = s.Take(ctx, "k", limit, 6, epoch.Add(15*time.Minute))
+	assert.NoError(err)
+	assert.False(res.Allowed)
+	assert.Zero(res.RetryAfter)
+
+	// once the window is empty the key is reset
+	res, err = s.Take(ctx, "k", limit, 5, epoch.Add(time.Hour))
+	assert.NoError(err)
+	assert.Equal(ratelimit.TakeResult{Allowed: true, Remaining: 0, ResetAfter: 15 * time.Minute}, res)
+}
+
+func TestSlidingLog_Refill(t *testing.T) {
+	assert := a.New(t)
+
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 3, Algorithm: ratelimit.SlidingLog}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	assert.Equal(3, takeAll(t, s, "k", limit, now))
+	assert.NoError(s.Refill(ctx, "k", limit, 1))
+	assert.Equal(1, takeAll(t, s, "k", limit, now))
+	assert.NoError(s.Refill(ctx, "k", limit, 10))
+	assert.Equal(3, takeAll(t, s, "k", limit, now))
+}
+
+func TestSlidingLog_ChangedCapacity(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(4, takeAll(t, s, "k", ratelimit.Limit{Rate: time.Second, Capacity: 4, Algorithm: ratelimit.SlidingLog}, now))
+	// like the other algorithms, the key starts over with a new log
+	assert.Equal(2, takeAll(t, s, "k", ratelimit.Limit{Rate: time.Second, Capacity: 2, Algorithm: ratelimit.SlidingLog}, now))
+	assert.Equal(6, takeAll(t, s, "k", ratelimit.Limit{Rate: time.Second, Capacity: 6, Algorithm: ratelimit.SlidingLog}, now))
+}
+
+func TestSlidingLog_BoundedCapacity(t *testing.T) {
+	assert := a.New(t)
+
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	_, err := s.Take(context.Background(), "k", ratelimit.Limit{Rate: time.Millisecond, Capacity: 10001, Algorithm: ratelimit.SlidingLog}, 1, time.Now())
+	assert.Error(err)
+
+	_, err = ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{RequestsPerMinute: 20000, Context: context.Background(), Algorithm: ratelimit.SlidingLog})
+	assert.Error(err)
+
+	_, err = ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{RequestsPerMinute: 5, Context: context.Background(), Algorithm: ratelimit.SlidingLog})
+	assert.NoError(err)
+}
+
+func TestSlidingLog_EvictKeepsActiveWindow(t *testing.T) {
+	assert := a.New(t)
+
+	limit := ratelimit.Limit{Rate: 3 * time.Minute, Capacity: 5, Algorithm: ratelimit.SlidingLog}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	epoch := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	assert.Equal(5, takeAll(t, s, "k", limit, epoch))
+
+	// a cleanup with a stale duration shorter than the window must not
+	// reset the key while its requests still count
+	evicted, err := s.Evict(ctx, epoch.Add(10*time.Minute))
+	assert.NoError(err)
+	assert.Equal(0, evicted)
+	assert.Equal(0, takeAll(t, s, "k", limit, epoch.Add(10*time.Minute)))
+
+	evicted, err = s.Evict(ctx, epoch.Add(16*time.Minute))
+	assert.NoError(err)
+	assert.Equal(1, evicted)
+}
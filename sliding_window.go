@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// slidingWindowLength returns the length of the sliding window of limit.
+func slidingWindowLength(limit Limit) time.Duration {
+	return time.Duration(limit.Capacity) * limit.Rate
+}
+
+// advanceWindow moves the current window forward so that it contains now.
+// The caller must hold v.mu.
+func (v *Visitor) advanceWindow(window time.Duration, now time.Time) {
+	elapsed := now.Sub(v.lastToken)
+	switch {
+	case elapsed >= 2*window:
+		// Both windows are over; start a fresh one at now.
+		v.prev, v.tokens = 0, 0
+		v.lastToken = now
+	case elapsed >= window:
+		v.prev, v.tokens = v.tokens, 0
+		v.lastToken = v.lastToken.Add(window)
+	}
+}
+
+// slidingWindowUsed returns the weighted number of requests in the sliding
+// window ending at now. The caller must have advanced the window to now.
+func (v *Visitor) slidingWindowUsed(window time.Duration, now time.Time) float64 {
+	elapsed := max(now.Sub(v.lastToken), 0)
+	// Multiply before dividing so that exact results stay exact.
+	return float64(v.prev)*float64(window-elapsed)/float64(window) + float64(v.tokens)
+}
+
+// takeSlidingWindow counts n requests if the sliding window has room for
+// them. The caller must hold v.mu.
+func (v *Visitor) takeSlidingWindow(limit Limit, n int, now time.Time) TakeResult {
+	window := slidingWindowLength(limit)
+	v.advanceWindow(window, now)
+	used := v.slidingWindowUsed(window, now)
+
+	var res TakeResult
+	if n <= limit.Capacity && used+float64(n) <= float64(limit.Capacity) {
+		v.tokens += n
+		used += float64(n)
+		res.Allowed = true
+	} else if n <= limit.Capacity {
+		res.RetryAfter = v.slidingWindowRetryAfter(window, limit.Capacity, n, now)
+	}
+	res.Remaining = max(limit.Capacity-int(math.Ceil(used)), 0)
+
+	switch {
+	case v.tokens > 0:
+		// Requests of the current window count until the next one ends.
+		res.ResetAfter = v.lastToken.Add(2 * window).Sub(now)
+	case v.prev > 0:
+		res.ResetAfter = v.lastToken.Add(window).Sub(now)
+	}
+	return res
+}
+
+// slidingWindowRetryAfter returns the time until n more requests fit into
+// the sliding window. The weight of the previous window shrinks linearly,
+// so the point in time can be solved for directly. The caller must hold
+// v.mu and have advanced the window to now.
+func (v *Visitor) slidingWindowRetryAfter(window time.Duration, capacity, n int, now time.Time) time.Duration {
+	start := v.lastToken
+	prev, curr := v.prev, v.tokens
+	if capacity-curr-n < 0 {
+		// The current window alone is too full; wait for the next one, in
+		// which it becomes the previous window.
+		start = start.Add(window)
+		prev, curr = curr, 0
+	}
+	// prev * (1 - (t-start)/window) + curr + n <= capacity, solved for t
+	// with a single rounding step
+	excess := prev - (capacity - curr - n)
+	wait := float64(window) * float64(excess) / float64(prev)
+	at := start.Add(time.Duration(math.Ceil(wait)))
+	return max(at.Sub(now), 0)
+}
+
+// slidingWindowAvailable returns how many requests the sliding window
+// could take at now without modifying v. The caller must hold v.mu.
+func (v *Visitor) slidingWindowAvailable(limit Limit, now time.Time) int {
+	window := slidingWindowLength(limit)
+	prev, curr, start := v.prev, v.tokens, v.lastToken
+	v.advanceWindow(window, now)
+	used := v.slidingWindowUsed(window, now)
+	v.prev, v.tokens, v.lastToken = prev, curr, start
+	return max(limit.Capacity-int(math.Ceil(used)), 0)
+}
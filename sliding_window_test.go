@@ -0,0 +1,156 @@
+package ratelimit_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+
+	ratelimit "github.com/stfsy/go-rate-limit"
+)
+
+// takeAll takes single tokens for key until the store rejects and returns
+// the number of allowed takes.
+func takeAll(t *testing.T, s ratelimit.Store, key string, limit ratelimit.Limit, now time.Time) int {
+	allowed := 0
+	for {
+		res, err := s.Take(context.Background(), key, limit, 1, now)
+		a.NoError(t, err)
+		if !res.Allowed {
+			return allowed
+		}
+		allowed++
+	}
+}
+
+func TestSlidingWindow_BurstBoundary(t *testing.T) {
+	assert := a.New(t)
+
+	// 60 requests per minute enforced by both algorithms
+	bucket := ratelimit.Limit{Rate: time.Second, Capacity: 60}
+	window := ratelimit.Limit{Rate: time.Second, Capacity: 60, Algorithm: ratelimit.SlidingWindow}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	epoch := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(60, takeAll(t, s, "bucket", bucket, epoch))
+	assert.Equal(60, takeAll(t, s, "window", window, epoch))
+
+	// half a minute later the token bucket has refilled 30 tokens, while
+	// the window still holds all 60 requests
+	assert.Equal(30, takeAll(t, s, "bucket", bucket, epoch.Add(30*time.Second)))
+	assert.Equal(0, takeAll(t, s, "window", window, epoch.Add(30*time.Second)))
+
+	// within the first minute and a half the bucket allowed 120 requests,
+	// the window no more than 60 in any rolling minute
+	assert.Equal(30, takeAll(t, s, "bucket", bucket, epoch.Add(60*time.Second)))
+	assert.Equal(0, takeAll(t, s, "window", window, epoch.Add(60*time.Second)))
+	assert.Equal(30, takeAll(t, s, "window", window, epoch.Add(90*time.Second)))
+}
+
+func TestSlidingWindow_Result(t *testing.T) {
+	assert := a.New(t)
+
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 60, Algorithm: ratelimit.SlidingWindow}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	epoch := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	res, err := s.Take(ctx, "k", limit, 20, epoch)
+	assert.NoError(err)
+	// requests of the current window count until the end of the next one
+	assert.Equal(ratelimit.TakeResult{Allowed: true, Remaining: 40, ResetAfter: 2 * time.Minute}, res)
+
+	res, err = s.Take(ctx, "k", limit, 40, epoch.Add(10*time.Second))
+	assert.NoError(err)
+	assert.Equal(ratelimit.TakeResult{Allowed: true, Remaining: 0, ResetAfter: 110 * time.Second}, res)
+
+	// 60 requests in the first window: in the second window their weight
+	// has to drop to 59 before another request fits, which takes 1s
+	res, err = s.Take(ctx, "k", limit, 1, epoch.Add(20*time.Second))
+	assert.NoError(err)
+	assert.Equal(ratelimit.TakeResult{Remaining: 0, ResetAfter: 100 * time.Second, RetryAfter: 41 * time.Second}, res)
+
+	res, err = s.Take(ctx, "k", limit, 1, epoch.Add(61*time.Second))
+	assert.NoError(err)
+	assert.True(res.Allowed)
+
+	// 30s into the second window half of the previous window still counts
+	res, err = s.Take(ctx, "k", limit, 30, epoch.Add(90*time.Second))
+	assert.NoError(err)
+	assert.False(res.Allowed)
+	assert.Equal(29, res.Remaining)
+	assert.Equal(time.Second, res.RetryAfter)
+
+	// more than the capacity never fits
+	res, err = s.Take(ctx, "k", limit, 61, epoch.Add(90*time.Second))
+	assert.NoError(err)
+	assert.False(res.Allowed)
+	assert.Zero(res.RetryAfter)
+
+	// after two idle windows the key starts over
+	res, err = s.Take(ctx, "k", limit, 60, epoch.Add(5*time.Minute))
+	assert.NoError(err)
+	assert.True(res.Allowed)
+}
+
+func TestSlidingWindow_Refill(t *testing.T) {
+	assert := a.New(t)
+
+	limit := ratelimit.Limit{Rate: time.Second, Capacity: 3, Algorithm: ratelimit.SlidingWindow}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ctx := context.Background()
+
+	assert.Equal(3, takeAll(t, s, "k", limit, now))
+	assert.NoError(s.Refill(ctx, "k", limit, 2))
+	assert.Equal(2, takeAll(t, s, "k", limit, now))
+	// refunds never go below an empty window
+	assert.NoError(s.Refill(ctx, "k", limit, 10))
+	assert.Equal(3, takeAll(t, s, "k", limit, now))
+}
+
+func TestMemoryStore_SwitchingAlgorithmResetsKey(t *testing.T) {
+	assert := a.New(t)
+
+	bucket := ratelimit.Limit{Rate: time.Second, Capacity: 3}
+	window := ratelimit.Limit{Rate: time.Second, Capacity: 3, Algorithm: ratelimit.SlidingWindow}
+	s := ratelimit.NewMemoryStore(ratelimit.MemoryStoreConfig{})
+	now := time.Now()
+
+	assert.Equal(3, takeAll(t, s, "k", bucket, now))
+	assert.Equal(3, takeAll(t, s, "k", window, now))
+
+	_, err := s.Take(context.Background(), "k", ratelimit.Limit{Rate: time.Second, Capacity: 3, Algorithm: 42}, 1, now)
+	assert.Error(err)
+}
+
+func TestRateLimitMiddleware_SlidingWindow(t *testing.T) {
+	assert := a.New(t)
+
+	middleware, err := ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{
+		RequestsPerMinute: 2,
+		Context:           context.Background(),
+		Algorithm:         ratelimit.SlidingWindow,
+	})
+	assert.NoError(err)
+
+	codes := make([]int, 0, 3)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rw := httptest.NewRecorder()
+		middleware(rw, req, func(w http.ResponseWriter, r *http.Request) {})
+		codes = append(codes, rw.Code)
+		if i == 2 {
+			assert.Equal(`"default";q=2;w=60`, rw.Header().Get("RateLimit-Policy"))
+			assert.Equal("90", rw.Header().Get("Retry-After"))
+		}
+	}
+	assert.Equal([]int{200, 200, 429}, codes)
+
+	_, err = ratelimit.RateLimitMiddleware(ratelimit.RateLimiterConfig{RequestsPerMinute: 2, Context: context.Background(), Algorithm: 42})
+	assert.Error(err)
+}
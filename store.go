@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrStoreFull is returned by a Store when a new key cannot be tracked
+// because the store has reached its configured capacity.
+var ErrStoreFull = errors.New("store is full")
+
+// Limit describes the token bucket applied to a single key.
+type Limit struct {
+	// Rate is the time it takes to refill a single token.
+	Rate time.Duration
+	// Capacity is the maximum number of tokens a bucket can hold. New
+	// buckets start out full.
+	Capacity int
+	// Algorithm selects how the limit is enforced. The zero value is
+	// TokenBucket; stores return an error for algorithms they do not
+	// support.
+	Algorithm Algorithm
+}
+
+// TakeResult is the outcome of a Store.Take call.
+type TakeResult struct {
+	// Allowed reports whether the requested tokens were removed.
+	Allowed bool
+	// Remaining is the number of tokens left in the bucket after the call.
+	Remaining int
+	// ResetAfter is the time until the bucket is full again.
+	ResetAfter time.Duration
+	// RetryAfter is the time until the requested tokens will be available.
+	// It is zero when the take was allowed or can never succeed because
+	// more tokens were requested than the bucket holds.
+	RetryAfter time.Duration
+}
+
+// Store holds the per-key bucket state of a RateLimiter. Implementations
+// must be safe for concurrent use: Take is called for every request while
+// Evict is called from the background cleanup goroutine. RateLimitMiddleware
+// passes the context of the request to Take and Refill, so stores should
+// give up once it is done.
+//
+// The package ships an in-memory implementation (MemoryStore). Custom
+// implementations can be verified with the conformance suite in the
+// storetest package.
+type Store interface {
+	// Take refills the bucket stored under key up to now and then removes n
+	// tokens if at least n are available. Unknown keys start with a full
+	// bucket. Take must perform the refill and the removal atomically.
+	Take(ctx context.Context, key string, limit Limit, n int, now time.Time) (TakeResult, error)
+	// Refill puts n tokens back into the bucket stored under key without
+	// exceeding the limit's capacity. Refilling an unknown key is a no-op.
+	Refill(ctx context.Context, key string, limit Limit, n int) error
+	// Evict removes buckets that have not been refilled since cutoff and
+	// returns the number of removed entries. Stores that expire entries on
+	// their own may always return zero.
+	Evict(ctx context.Context, cutoff time.Time) (int, error)
+	// Len returns the number of buckets currently held by the store.
+	Len(ctx context.Context) (int, error)
+}
+
+// MultiTaker is implemented by stores that keep all limits of a key in a
+// single entry and check them atomically. Composite rate limiters use it
+// instead of calling Take once per limit, so a request never takes tokens
+// from one limit that are returned after another one rejected it, and the
+// key occupies a single entry. MemoryStore and RedisStore implement it.
+type MultiTaker interface {
+	// TakeAll refills the buckets of all limits stored under key up to now
+	// and removes n tokens from each of them if every one holds at least
+	// n; otherwise no tokens are removed. It returns one result per limit.
+	// Limits that allow the take report their bucket as if the tokens had
+	// been removed, even if another limit rejected it. Keys used with
+	// different limits may start over.
+	TakeAll(ctx context.Context, key string, limits []Limit, n int, now time.Time) ([]TakeResult, error)
+	// RefillAll puts n tokens back into every bucket stored under key
+	// without exceeding the capacities of limits. Refilling an unknown key
+	// is a no-op.
+	RefillAll(ctx context.Context, key string, limits []Limit, n int) error
+}
+
+// Reserver is implemented by stores that can hand out tokens ahead of
+// time. RateLimiter.Reserve and RateLimiter.Wait require it. MemoryStore
+// implements it for TokenBucket and GCRA.
+type Reserver interface {
+	MultiTaker
+	// Reserve is like TakeAll but also removes tokens that only become
+	// available in the future, as long as that is at most maxWait away
+	// for every limit. RetryAfter of an allowed result is the time until
+	// the reserved tokens are available. Reserved tokens are returned with
+	// RefillAll. A single limit shares its state with Take.
+	Reserve(ctx context.Context, key string, limits []Limit, n int, now time.Time, maxWait time.Duration) ([]TakeResult, error)
+}
+
+// AlgorithmSupporter is implemented by stores that enforce only some of the
+// algorithms. RateLimitMiddleware returns an error when such a store is
+// configured with a limit it does not support, instead of failing every
+// request. Stores that do not implement it are assumed to support all
+// algorithms.
+type AlgorithmSupporter interface {
+	// Supports reports whether the store can enforce limits using alg.
+	Supports(alg Algorithm) bool
+}
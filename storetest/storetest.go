@@ -0,0 +1,303 @@
+// Package storetest provides a conformance suite for ratelimit.Store
+// implementations. Store authors call Run from a regular Go test:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) ratelimit.Store {
+//			return NewMyStore()
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+
+	ratelimit "github.com/stfsy/go-rate-limit"
+)
+
+// NewStoreFunc returns an empty store. It is called once per subtest.
+type NewStoreFunc func(t *testing.T) ratelimit.Store
+
+// epoch is the fixed point in time all subtests start from. The suite never
+// relies on the wall clock; every call passes an explicit now.
+var epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// limit is used by most subtests: three tokens, one refilled per second.
+var limit = ratelimit.Limit{Rate: time.Second, Capacity: 3}
+
+// limits are used by the subtests of ratelimit.MultiTaker: limit and five
+// tokens, one refilled per hour.
+var limits = []ratelimit.Limit{limit, {Rate: time.Hour, Capacity: 5}}
+
+// Run runs the conformance suite against the stores returned by newStore.
+// The TakeAll subtests are skipped for stores that do not implement
+// ratelimit.MultiTaker.
+func Run(t *testing.T, newStore NewStoreFunc) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s ratelimit.Store)
+	}{
+		{"TakeWithinCapacity", testTakeWithinCapacity},
+		{"TakeN", testTakeN},
+		{"TakeMoreThanCapacity", testTakeMoreThanCapacity},
+		{"RefillOverTime", testRefillOverTime},
+		{"PreservesFractionalRemainder", testPreservesFractionalRemainder},
+		{"CapsAtCapacityAfterIdle", testCapsAtCapacityAfterIdle},
+		{"IndependentKeys", testIndependentKeys},
+		{"Refill", testRefill},
+		{"RefillUnknownKey", testRefillUnknownKey},
+		{"Len", testLen},
+		{"Evict", testEvict},
+		{"ConcurrentTake", testConcurrentTake},
+		{"TakeAll", testTakeAll},
+		{"TakeAllMoreThanCapacity", testTakeAllMoreThanCapacity},
+		{"RefillAll", testRefillAll},
+		{"TakeAllUsesOneKey", testTakeAllUsesOneKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func take(t *testing.T, s ratelimit.Store, key string, n int, now time.Time) ratelimit.TakeResult {
+	t.Helper()
+	res, err := s.Take(context.Background(), key, limit, n, now)
+	a.NoError(t, err)
+	return res
+}
+
+func takeAll(t *testing.T, s ratelimit.Store, key string, n int, now time.Time) []ratelimit.TakeResult {
+	t.Helper()
+	res, err := multiTaker(t, s).TakeAll(context.Background(), key, limits, n, now)
+	a.NoError(t, err)
+	a.Len(t, res, len(limits))
+	return res
+}
+
+// multiTaker returns s as a MultiTaker or skips the test.
+func multiTaker(t *testing.T, s ratelimit.Store) ratelimit.MultiTaker {
+	t.Helper()
+	mt, ok := s.(ratelimit.MultiTaker)
+	if !ok {
+		t.Skipf("%T does not implement MultiTaker", s)
+	}
+	return mt
+}
+
+func result(allowed bool, remaining int, resetAfter, retryAfter time.Duration) ratelimit.TakeResult {
+	return ratelimit.TakeResult{Allowed: allowed, Remaining: remaining, ResetAfter: resetAfter, RetryAfter: retryAfter}
+}
+
+func testTakeWithinCapacity(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	assert.Equal(result(true, 2, time.Second, 0), take(t, s, "k", 1, epoch))
+	assert.Equal(result(true, 1, 2*time.Second, 0), take(t, s, "k", 1, epoch))
+	assert.Equal(result(true, 0, 3*time.Second, 0), take(t, s, "k", 1, epoch))
+	assert.Equal(result(false, 0, 3*time.Second, time.Second), take(t, s, "k", 1, epoch))
+	// the reset time counts down while the bucket refills
+	assert.Equal(result(false, 0, 2500*time.Millisecond, 500*time.Millisecond), take(t, s, "k", 1, epoch.Add(limit.Rate/2)))
+}
+
+func testTakeN(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	assert.Equal(result(true, 1, 2*time.Second, 0), take(t, s, "k", 2, epoch))
+	// a failed take must not consume the tokens that are left
+	assert.Equal(result(false, 1, 2*time.Second, time.Second), take(t, s, "k", 2, epoch))
+	assert.Equal(result(true, 0, 3*time.Second, 0), take(t, s, "k", 1, epoch))
+}
+
+func testTakeMoreThanCapacity(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	res := take(t, s, "k", limit.Capacity+1, epoch)
+	assert.False(res.Allowed)
+	assert.Zero(res.RetryAfter, "a take that can never succeed has no retry time")
+	// the full bucket is still available
+	assert.True(take(t, s, "k", limit.Capacity, epoch).Allowed)
+}
+
+func testRefillOverTime(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	take(t, s, "k", limit.Capacity, epoch)
+	assert.False(take(t, s, "k", 1, epoch.Add(limit.Rate-time.Millisecond)).Allowed)
+	assert.True(take(t, s, "k", 1, epoch.Add(limit.Rate)).Allowed)
+	assert.False(take(t, s, "k", 1, epoch.Add(limit.Rate)).Allowed)
+	assert.Equal(result(true, 2, time.Second, 0), take(t, s, "k", 1, epoch.Add(4*limit.Rate)))
+}
+
+func testPreservesFractionalRemainder(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	take(t, s, "k", limit.Capacity, epoch)
+	// one and a half intervals refill one token; the remaining half interval
+	// must count towards the next token
+	assert.True(take(t, s, "k", 1, epoch.Add(limit.Rate*3/2)).Allowed)
+	assert.True(take(t, s, "k", 1, epoch.Add(2*limit.Rate)).Allowed)
+	assert.False(take(t, s, "k", 1, epoch.Add(2*limit.Rate)).Allowed)
+}
+
+func testCapsAtCapacityAfterIdle(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	take(t, s, "k", limit.Capacity, epoch)
+	later := epoch.Add(time.Hour)
+	for i := 0; i < limit.Capacity; i++ {
+		assert.True(take(t, s, "k", 1, later).Allowed)
+	}
+	assert.False(take(t, s, "k", 1, later).Allowed, "a long idle period must not refill more than capacity")
+}
+
+func testIndependentKeys(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	take(t, s, "a", limit.Capacity, epoch)
+	assert.False(take(t, s, "a", 1, epoch).Allowed)
+	assert.True(take(t, s, "b", 1, epoch).Allowed)
+}
+
+func testRefill(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	take(t, s, "k", limit.Capacity, epoch)
+	assert.NoError(s.Refill(context.Background(), "k", limit, 2))
+	assert.Equal(result(true, 1, 2*time.Second, 0), take(t, s, "k", 1, epoch))
+
+	// refilling never exceeds capacity
+	assert.NoError(s.Refill(context.Background(), "k", limit, 10))
+	assert.Equal(result(true, 0, 3*time.Second, 0), take(t, s, "k", limit.Capacity, epoch))
+}
+
+func testRefillUnknownKey(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	assert.NoError(s.Refill(context.Background(), "unknown", limit, 1))
+	assert.Equal(result(true, 2, time.Second, 0), take(t, s, "unknown", 1, epoch))
+}
+
+func testLen(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	n, err := s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(0, n)
+
+	for i := 0; i < 5; i++ {
+		take(t, s, fmt.Sprintf("k%d", i), 1, epoch)
+	}
+	take(t, s, "k0", 1, epoch)
+
+	n, err = s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(5, n)
+}
+
+func testEvict(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	take(t, s, "idle", 1, epoch)
+	take(t, s, "active", 1, epoch.Add(10*time.Minute))
+
+	before, err := s.Len(context.Background())
+	assert.NoError(err)
+
+	evicted, err := s.Evict(context.Background(), epoch.Add(5*time.Minute))
+	assert.NoError(err)
+	assert.LessOrEqual(evicted, 1, "only the idle bucket may be evicted")
+
+	after, err := s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(before-evicted, after)
+
+	// the active bucket keeps its state
+	assert.Equal(result(true, 0, 3*time.Second, 0), take(t, s, "active", 2, epoch.Add(10*time.Minute)))
+}
+
+func testConcurrentTake(t *testing.T, s ratelimit.Store) {
+	limit := ratelimit.Limit{Rate: time.Hour, Capacity: 50}
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4*limit.Capacity; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := s.Take(context.Background(), "k", limit, 1, epoch)
+			if err == nil && res.Allowed {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	a.Equal(t, int64(limit.Capacity), allowed.Load())
+}
+
+func testTakeAll(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	assert.Equal([]ratelimit.TakeResult{
+		result(true, 0, 3*time.Second, 0),
+		result(true, 2, 3*time.Hour, 0),
+	}, takeAll(t, s, "k", 3, epoch))
+
+	// the first limit rejects; the second one reports the take it would
+	// have allowed but keeps its tokens
+	assert.Equal([]ratelimit.TakeResult{
+		result(false, 0, 3*time.Second, time.Second),
+		result(true, 1, 4*time.Hour, 0),
+	}, takeAll(t, s, "k", 1, epoch))
+
+	now := epoch.Add(2 * time.Second)
+	assert.Equal([]ratelimit.TakeResult{
+		result(true, 0, 3*time.Second, 0),
+		result(true, 0, 5*time.Hour-2*time.Second, 0),
+	}, takeAll(t, s, "k", 2, now))
+}
+
+func testTakeAllMoreThanCapacity(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	res := takeAll(t, s, "k", limit.Capacity+1, epoch)
+	assert.False(res[0].Allowed)
+	assert.Zero(res[0].RetryAfter, "a take that can never succeed has no retry time")
+	// the full buckets are still available
+	res = takeAll(t, s, "k", limit.Capacity, epoch)
+	assert.True(res[0].Allowed)
+	assert.True(res[1].Allowed)
+}
+
+func testRefillAll(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	takeAll(t, s, "k", 3, epoch)
+	assert.NoError(multiTaker(t, s).RefillAll(context.Background(), "k", limits, 2))
+	assert.Equal([]ratelimit.TakeResult{
+		result(true, 1, 2*time.Second, 0),
+		result(true, 3, 2*time.Hour, 0),
+	}, takeAll(t, s, "k", 1, epoch))
+
+	// refilling an unknown key is a no-op
+	assert.NoError(multiTaker(t, s).RefillAll(context.Background(), "unknown", limits, 1))
+	assert.True(takeAll(t, s, "unknown", limit.Capacity, epoch)[0].Allowed)
+}
+
+func testTakeAllUsesOneKey(t *testing.T, s ratelimit.Store) {
+	assert := a.New(t)
+
+	takeAll(t, s, "a", 1, epoch)
+	takeAll(t, s, "b", 1, epoch)
+
+	n, err := s.Len(context.Background())
+	assert.NoError(err)
+	assert.Equal(2, n)
+}
@@ -2,11 +2,17 @@
 
 set -euo pipefail
 
-go vet ./...
+# ratelimitotel is a separate module so the core does not depend on OpenTelemetry
+for module in . ratelimitotel; do
+    (
+        cd "$module"
+        go vet ./...
 
-# if GITHUB_ACTIONS is set then we are running in CI
-if [[ "${GITHUB_ACTIONS:-}" != "" ]]; then
-    go test -cover -race -timeout 2s ./...
-else
-    go test -cover -timeout 2s ./...
-fi
\ No newline at end of file
+        # if GITHUB_ACTIONS is set then we are running in CI
+        if [[ "${GITHUB_ACTIONS:-}" != "" ]]; then
+            go test -cover -race -timeout 2s ./...
+        else
+            go test -cover -timeout 2s ./...
+        fi
+    )
+done
\ No newline at end of file
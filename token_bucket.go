@@ -0,0 +1,138 @@
+package ratelimit
+
+import (
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// tokenBucketEntry is the entry of a key limited with the TokenBucket
+// algorithm. The tokens and the time of the last refill are packed into a
+// single int64, updated with compare-and-swap, so requests for a hot key
+// never wait for a lock.
+//
+// The state is lastToken - tokens * Rate in Unix nanoseconds: the time at
+// which an empty bucket refilled at Rate would hold the current tokens at
+// lastToken. The tokens at now are floor((now - state) / Rate), capped at
+// Capacity. Refilling without reaching Capacity leaves the state as it
+// is, so the fractional remainder of the elapsed interval is kept exactly
+// as a separate lastToken would keep it; reaching Capacity moves the state
+// by whole tokens only. Requests whose now lies before the last refill see
+// the bucket as of their own time.
+type tokenBucketEntry struct {
+	entryMeta
+	// limit is the limit the entry was created for. A key used with a
+	// different limit gets a new entry.
+	limit Limit
+	state atomic.Int64
+}
+
+// newTokenBucketEntry returns a full bucket for limit.
+func newTokenBucketEntry(limit Limit, now time.Time) *tokenBucketEntry {
+	e := &tokenBucketEntry{limit: limit}
+	e.state.Store(now.UnixNano() - int64(limit.Capacity)*int64(limit.Rate))
+	return e
+}
+
+// holds implements bucket.
+func (e *tokenBucketEntry) holds(limit Limit) bool {
+	return limit == e.limit
+}
+
+// take implements bucket. Taking is reserving without waiting: n tokens
+// are only removed if they are available now.
+func (e *tokenBucketEntry) take(limit Limit, n int, now time.Time) TakeResult {
+	return e.reserve(limit, n, now, 0)
+}
+
+// reserve implements bucket. Tokens that are not available yet leave the
+// bucket below zero. It retries until the state it computed from is still
+// current.
+func (e *tokenBucketEntry) reserve(limit Limit, n int, now time.Time, maxWait time.Duration) TakeResult {
+	for {
+		state := e.state.Load()
+		res, next := tokenBucketReserve(state, limit, n, now, maxWait)
+		if next == state || e.state.CompareAndSwap(state, next) {
+			return res
+		}
+	}
+}
+
+// refund implements bucket. Tokens beyond Capacity are dropped the next
+// time the bucket is read, as if they were refilled.
+func (e *tokenBucketEntry) refund(limit Limit, n int) {
+	if limit != e.limit {
+		return
+	}
+	e.state.Add(-int64(n) * int64(limit.Rate))
+}
+
+// fill implements entry.
+func (e *tokenBucketEntry) fill(now time.Time) float64 {
+	return float64(e.tokens(now)) / float64(e.limit.Capacity)
+}
+
+// size implements entry.
+func (e *tokenBucketEntry) size() int64 {
+	return int64(unsafe.Sizeof(*e))
+}
+
+// tokens returns the tokens the bucket holds at now, negative for
+// reserved tokens that are not refilled yet.
+func (e *tokenBucketEntry) tokens(now time.Time) int {
+	tokens, _ := tokenBucketRefill(e.state.Load(), e.limit, now.UnixNano())
+	return int(tokens)
+}
+
+// activeUntil implements entry. Once the bucket is full again, forgetting
+// it loses nothing.
+func (e *tokenBucketEntry) activeUntil() time.Time {
+	return time.Unix(0, e.state.Load()+int64(e.limit.Capacity)*int64(e.limit.Rate))
+}
+
+// tokenBucketReserve refills the bucket with the given state and removes n
+// tokens if they are available within maxWait. It returns the outcome and
+// the new state.
+func tokenBucketReserve(state int64, limit Limit, n int, now time.Time, maxWait time.Duration) (TakeResult, int64) {
+	t := now.UnixNano()
+	rate := int64(limit.Rate)
+	tokens, state := tokenBucketRefill(state, limit, t)
+
+	var res TakeResult
+	if n <= limit.Capacity {
+		if tokens < int64(n) {
+			// lastToken + (n - tokens) * Rate
+			res.RetryAfter = time.Duration(state + int64(n)*rate - t)
+		}
+		res.Allowed = res.RetryAfter <= maxWait
+	}
+	if res.Allowed {
+		tokens -= int64(n)
+		state += int64(n) * rate
+	}
+	res.Remaining = int(max(tokens, 0))
+	// The bucket is full at lastToken + (Capacity - tokens) * Rate.
+	res.ResetAfter = time.Duration(max(state+int64(limit.Capacity)*rate-t, 0))
+	return res, state
+}
+
+// tokenBucketRefill returns the tokens held at t, in Unix nanoseconds, and
+// the state with tokens beyond Capacity dropped.
+func tokenBucketRefill(state int64, limit Limit, t int64) (int64, int64) {
+	rate := int64(limit.Rate)
+	tokens := floorDiv(t-state, rate)
+	if excess := tokens - int64(limit.Capacity); excess > 0 {
+		state += excess * rate
+		tokens = int64(limit.Capacity)
+	}
+	return tokens, state
+}
+
+// floorDiv returns a / b rounded towards negative infinity for b > 0.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b < 0 {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	a "github.com/stretchr/testify/assert"
+)
+
+// refBucket is the token bucket as it was kept before it was packed into a
+// single word: the tokens and the time of the last refill under a mutex.
+type refBucket struct {
+	tokens    int
+	lastToken time.Time
+}
+
+func (b *refBucket) refill(limit Limit, now time.Time) {
+	add := int64(now.Sub(b.lastToken) / limit.Rate)
+	if add <= 0 {
+		return
+	}
+	if add >= int64(limit.Capacity-b.tokens) {
+		b.tokens = limit.Capacity
+	} else {
+		b.tokens += int(add)
+	}
+	b.lastToken = b.lastToken.Add(time.Duration(add) * limit.Rate)
+}
+
+func (b *refBucket) reserve(limit Limit, n int, now time.Time, maxWait time.Duration) TakeResult {
+	b.refill(limit, now)
+	var res TakeResult
+	if n <= limit.Capacity {
+		if b.tokens < n {
+			res.RetryAfter = b.lastToken.Add(time.Duration(n-b.tokens) * limit.Rate).Sub(now)
+		}
+		res.Allowed = res.RetryAfter <= maxWait
+	}
+	if res.Allowed {
+		b.tokens -= n
+	}
+	res.Remaining = max(b.tokens, 0)
+	res.ResetAfter = max(b.lastToken.Add(time.Duration(limit.Capacity-b.tokens)*limit.Rate).Sub(now), 0)
+	return res
+}
+
+func TestTokenBucket_MatchesMutexBucket(t *testing.T) {
+	assert := a.New(t)
+
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for round := 0; round < 50; round++ {
+		limit := Limit{Rate: time.Duration(1+rnd.IntN(1000)) * time.Millisecond, Capacity: 1 + rnd.IntN(20)}
+		now := time.Date(2025, 1, 1, 0, 0, 0, rnd.IntN(1e9), time.UTC)
+		e := newTokenBucketEntry(limit, now)
+		ref := &refBucket{tokens: limit.Capacity, lastToken: now}
+
+		for step := 0; step < 100; step++ {
+			now = now.Add(time.Duration(rnd.Int64N(int64(3 * limit.Rate))))
+			n := rnd.IntN(limit.Capacity + 2)
+			switch rnd.IntN(4) {
+			case 0:
+				maxWait := time.Duration(rnd.Int64N(int64(limit.Capacity) * int64(limit.Rate)))
+				assert.Equal(ref.reserve(limit, n, now, maxWait), e.reserve(limit, n, now, maxWait), "round %d step %d", round, step)
+			case 1:
+				// Refunds are only made for tokens that were taken.
+				res := ref.reserve(limit, n, now, 0)
+				assert.Equal(res, e.take(limit, n, now), "round %d step %d", round, step)
+				if res.Allowed {
+					ref.tokens = min(ref.tokens+n, limit.Capacity)
+					e.refund(limit, n)
+				}
+			default:
+				assert.Equal(ref.reserve(limit, n, now, 0), e.take(limit, n, now), "round %d step %d", round, step)
+			}
+		}
+	}
+}
+
+func TestTokenBucket_KeepsFractionalRemainder(t *testing.T) {
+	assert := a.New(t)
+
+	limit := Limit{Rate: 100 * time.Millisecond, Capacity: 2}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	e := newTokenBucketEntry(limit, now)
+
+	// 1.05s of refills fill the bucket; the 50ms remainder is kept
+	now = now.Add(1050 * time.Millisecond)
+	assert.True(e.take(limit, 2, now).Allowed)
+	assert.Equal(TakeResult{RetryAfter: 50 * time.Millisecond, ResetAfter: 150 * time.Millisecond}, e.take(limit, 1, now))
+	assert.True(e.take(limit, 1, now.Add(50*time.Millisecond)).Allowed)
+}
+
+func TestTokenBucket_ConcurrentTake(t *testing.T) {
+	assert := a.New(t)
+
+	s := NewMemoryStore(MemoryStoreConfig{})
+	limit := Limit{Rate: time.Hour, Capacity: 1000}
+	now := time.Now()
+
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				res, err := s.Take(context.Background(), "k", limit, 1, now)
+				assert.NoError(err)
+				if res.Allowed {
+					allowed.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int64(1000), allowed.Load())
+	assert.Equal(0, s.load("k").(*tokenBucketEntry).tokens(now))
+}